@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"os"
 
 	"github.com/esm-dev/esm.sh/server"
 )
@@ -14,5 +15,18 @@ import (
 var fs embed.FS
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "snapshot":
+			server.Snapshot(os.Args[2:])
+			return
+		case "worker":
+			server.Worker(os.Args[2:])
+			return
+		case "build-worker":
+			server.BuildWorker()
+			return
+		}
+	}
 	server.Serve(&fs)
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime/debug"
 	"strings"
 	"time"
 
@@ -26,6 +28,10 @@ type ESMBuild struct {
 	TypesOnly        bool     `json:"o,omitempty"`
 	PackageCSS       bool     `json:"s,omitempty"`
 	Deps             []string `json:"p,omitempty"`
+	// SHA-256 checksums of the build artifacts, keyed by the save path
+	Checksums map[string]string `json:"h,omitempty"`
+	// SRI hashes(sha384) of the build artifacts, keyed by the save path
+	Integrity map[string]string `json:"i,omitempty"`
 }
 
 type BuildTask struct {
@@ -48,9 +54,35 @@ type BuildTask struct {
 	headerLines int // to fix the source map
 	esm         *ESMBuild
 	npm         NpmPackage
+	checksums   *stringMap
+	integrity   *stringMap
+	ctx         context.Context
+	progress    *buildProgress
+	depth       int // the depth of the dependency prebuild
+	// the prebuild budget of the root build, see `prebuildDeps`
+	prebuildBudget *prebuildBudget
 }
 
-func (task *BuildTask) Build() (esm *ESMBuild, err error) {
+// safeBuild recovers the panic of the build and returns it as an error, the panics in the goroutines
+// that are started by the build can't be recovered, use the build worker mode to isolate them.
+func (task *BuildTask) safeBuild(ctx context.Context) (esm *ESMBuild, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Errorf("build '%s': panic: %v\n%s", task.ID(), v, debug.Stack())
+			esm = nil
+			err = fmt.Errorf("build '%s': panic: %v", task.ID(), v)
+		}
+	}()
+	return buildFunc(task, ctx)
+}
+
+// buildFunc builds the task in `safeBuild`, it's replaced in the tests.
+var buildFunc = (*BuildTask).Build
+
+// Build builds the task, the build is canceled when the context is done.
+func (task *BuildTask) Build(ctx context.Context) (esm *ESMBuild, err error) {
+	task.ctx = ctx
+
 	// check request package
 	if !task.Pkg.FromEsmsh && !task.Pkg.FromGithub {
 		var p NpmPackage
@@ -61,6 +93,9 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		task.Deprecated = p.Deprecated
 	}
 
+	task.checksums = newStringMap()
+	task.integrity = newStringMap()
+
 	pkgVersionName := task.Pkg.VersionName()
 	if task.wd == "" {
 		task.wd = path.Join(cfg.WorkDir, fmt.Sprintf("npm/%s", pkgVersionName))
@@ -118,9 +153,14 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		toPurge(pkgVersionName, dir)
 	}(task.wd, pkgVersionName)
 
-	task.stage = "install"
-
-	err = installPackage(task.wd, task.Pkg)
+	// the install stage is network-bound, it has its own concurrency limit
+	err = installPool.acquire(ctx)
+	if err != nil {
+		return
+	}
+	task.setStage("install")
+	err = installPackage(ctx, task.wd, task.Pkg)
+	installPool.release()
 	if err != nil {
 		return
 	}
@@ -141,8 +181,14 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		return
 	}
 
-	task.stage = "build"
+	pool := task.stagePool()
+	err = pool.acquire(ctx)
+	if err != nil {
+		return
+	}
+	task.setStage("build")
 	err = task.build()
+	pool.release()
 	if err != nil {
 		return
 	}
@@ -162,7 +208,7 @@ func (task *BuildTask) build() (err error) {
 			}
 			buffer := bytes.NewBufferString("export default ")
 			buffer.Write(json)
-			_, err = fs.WriteFile(task.getSavepath(), buffer)
+			err = task.writeArtifact(task.getSavepath(), buffer)
 			if err != nil {
 				return err
 			}
@@ -211,9 +257,10 @@ func (task *BuildTask) build() (err error) {
 			Target: task.Target,
 			Dev:    task.Dev,
 			wd:     task.installDir,
+			ctx:    task.ctx,
 		}
 		if !formJson {
-			err = installPackage(task.wd, t.Pkg)
+			err = installPackage(task.context(), task.wd, t.Pkg)
 			if err != nil {
 				return
 			}
@@ -232,7 +279,7 @@ func (task *BuildTask) build() (err error) {
 			fmt.Fprintf(buf, `export { default } from "%s";`, importPath)
 		}
 
-		_, err = fs.WriteFile(task.getSavepath(), buf)
+		err = task.writeArtifact(task.getSavepath(), buf)
 		if err != nil {
 			return
 		}
@@ -306,6 +353,11 @@ func (task *BuildTask) build() (err error) {
 	implicitExternal := newStringSet()
 
 rebuild:
+	// stop rebuilding if the task is canceled
+	err = task.context().Err()
+	if err != nil {
+		return
+	}
 	options := api.BuildOptions{
 		Outdir:            "/esbuild",
 		Write:             false,
@@ -659,7 +711,11 @@ rebuild:
 	} else if entryPoint != "" {
 		options.EntryPoints = []string{entryPoint}
 	}
-	result := api.Build(options)
+	result := esbuild(task.context(), options)
+	err = task.context().Err()
+	if err != nil {
+		return
+	}
 	if len(result.Errors) > 0 {
 		// mark the missing module as external to exclude it from the bundle
 		msg := result.Errors[0].Text
@@ -673,6 +729,7 @@ rebuild:
 			if !implicitExternal.Has(name) {
 				log.Warnf("build(%s): implicit external '%s'", task.ID(), name)
 				implicitExternal.Add(name)
+				task.emit(BuildEvent{Type: "rebuild", External: name})
 				goto rebuild
 			}
 		}
@@ -777,9 +834,10 @@ rebuild:
 									Target: task.Target,
 									Dev:    task.Dev,
 									wd:     task.installDir,
+									ctx:    task.ctx,
 								}
 								if !formJson {
-									e = installPackage(task.wd, t.Pkg)
+									e = installPackage(task.context(), task.wd, t.Pkg)
 								}
 								if e == nil {
 									m, _, _, e := t.analyze(true)
@@ -822,7 +880,7 @@ rebuild:
 			finalContent.WriteString(filepath.Base(task.ID()))
 			finalContent.WriteString(".map")
 
-			_, err = fs.WriteFile(task.getSavepath(), finalContent)
+			err = task.writeArtifact(task.getSavepath(), finalContent)
 			if err != nil {
 				return
 			}
@@ -832,7 +890,7 @@ rebuild:
 	for _, file := range result.OutputFiles {
 		if strings.HasSuffix(file.Path, ".css") {
 			savePath := task.getSavepath()
-			_, err = fs.WriteFile(strings.TrimSuffix(savePath, path.Ext(savePath))+".css", bytes.NewReader(file.Contents))
+			err = task.writeArtifact(strings.TrimSuffix(savePath, path.Ext(savePath))+".css", bytes.NewReader(file.Contents))
 			if err != nil {
 				return
 			}
@@ -850,7 +908,7 @@ rebuild:
 				}
 				buf := bytes.NewBuffer(nil)
 				if json.NewEncoder(buf).Encode(sourceMap) == nil {
-					_, err = fs.WriteFile(task.getSavepath()+".map", buf)
+					err = task.writeArtifact(task.getSavepath()+".map", buf)
 					if err != nil {
 						return
 					}
@@ -1029,6 +1087,12 @@ func (task *BuildTask) resolveExternal(specifier string, kind api.ResolveKind) s
 }
 
 func (task *BuildTask) storeToDB() {
+	if task.checksums != nil {
+		task.esm.Checksums = task.checksums.Map()
+	}
+	if task.integrity != nil {
+		task.esm.Integrity = task.integrity.Map()
+	}
 	err := db.Put(task.ID(), utils.MustEncodeJSON(task.esm))
 	if err != nil {
 		log.Errorf("db: %v", err)
@@ -1077,7 +1141,7 @@ func (task *BuildTask) checkDTS() {
 
 func (task *BuildTask) buildDTS(dts string) {
 	start := time.Now()
-	task.stage = "transform-dts"
+	task.setStage("transform-dts")
 	n, err := task.TransformDTS(dts)
 	if err != nil && os.IsExist(err) {
 		log.Errorf("TransformDTS(%s): %v", dts, err)
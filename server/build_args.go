@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -20,6 +21,41 @@ type BuildArgs struct {
 	keepNames         bool
 }
 
+// newBuildArgs returns the empty build args of the package with the deps that apply to it.
+func newBuildArgs(pkg Pkg, deps PkgSlice) BuildArgs {
+	return BuildArgs{
+		alias:       map[string]string{},
+		deps:        pkgDeps(deps, pkg),
+		external:    newStringSet(),
+		treeShaking: newStringSet(),
+		conditions:  newStringSet(),
+	}
+}
+
+// pkgDeps returns the deps that apply to the package, the package itself is excluded, and the
+// `react` version always matches the `react-dom` version.
+func pkgDeps(deps PkgSlice, pkg Pkg) PkgSlice {
+	a := PkgSlice{}
+	for _, m := range deps {
+		if m.Name != pkg.Name && !(pkg.Name == "react-dom" && m.Name == "react") {
+			a = append(a, m)
+		}
+	}
+	return a
+}
+
+// fixStableBuildArgs clears the build args for the main entry of stable builds, except the conditions.
+func fixStableBuildArgs(args BuildArgs, pkg Pkg) BuildArgs {
+	if stableBuild[pkg.Name] && pkg.Submodule == "" {
+		return BuildArgs{
+			external:    newStringSet(),
+			treeShaking: newStringSet(),
+			conditions:  args.conditions,
+		}
+	}
+	return args
+}
+
 func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 	s, err := atobUrl(strings.TrimPrefix(strings.TrimSuffix(raw, "/"), "X-"))
 	if err == nil {
@@ -166,3 +202,63 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, forTypes bool) string {
 	}
 	return ""
 }
+
+// buildArgsJSON is the JSON representation of the `BuildArgs`, used by the build worker.
+type buildArgsJSON struct {
+	Alias             map[string]string `json:"alias,omitempty"`
+	Deps              PkgSlice          `json:"deps,omitempty"`
+	Conditions        []string          `json:"conditions,omitempty"`
+	External          []string          `json:"external,omitempty"`
+	TreeShaking       []string          `json:"treeShaking,omitempty"`
+	DenoStdVersion    string            `json:"denoStdVersion,omitempty"`
+	IgnoreAnnotations bool              `json:"ignoreAnnotations,omitempty"`
+	IgnoreRequire     bool              `json:"ignoreRequire,omitempty"`
+	KeepNames         bool              `json:"keepNames,omitempty"`
+}
+
+func (args BuildArgs) MarshalJSON() ([]byte, error) {
+	v := buildArgsJSON{
+		Alias:             args.alias,
+		Deps:              args.deps,
+		DenoStdVersion:    args.denoStdVersion,
+		IgnoreAnnotations: args.ignoreAnnotations,
+		IgnoreRequire:     args.ignoreRequire,
+		KeepNames:         args.keepNames,
+	}
+	if args.conditions != nil {
+		v.Conditions = args.conditions.Values()
+	}
+	if args.external != nil {
+		v.External = args.external.Values()
+	}
+	if args.treeShaking != nil {
+		v.TreeShaking = args.treeShaking.Values()
+	}
+	return json.Marshal(v)
+}
+
+func (args *BuildArgs) UnmarshalJSON(data []byte) error {
+	var v buildArgsJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*args = BuildArgs{
+		alias:             v.Alias,
+		deps:              v.Deps,
+		conditions:        newStringSet(v.Conditions...),
+		external:          newStringSet(v.External...),
+		treeShaking:       newStringSet(v.TreeShaking...),
+		denoStdVersion:    v.DenoStdVersion,
+		ignoreAnnotations: v.IgnoreAnnotations,
+		ignoreRequire:     v.IgnoreRequire,
+		keepNames:         v.KeepNames,
+	}
+	if args.alias == nil {
+		args.alias = map[string]string{}
+	}
+	if args.deps == nil {
+		args.deps = PkgSlice{}
+	}
+	return nil
+}
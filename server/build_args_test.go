@@ -66,3 +66,24 @@ func TestEncodeBuildArgs(t *testing.T) {
 	}
 	t.Log(prefix, args)
 }
+
+func TestNewBuildArgs(t *testing.T) {
+	deps := PkgSlice{{Name: "react", Version: "18.2.0"}, {Name: "foo", Version: "1.0.0"}}
+	args := newBuildArgs(Pkg{Name: "react-dom", Version: "18.2.0"}, deps)
+	if len(args.deps) != 1 || args.deps[0].Name != "foo" {
+		t.Fatalf("the `react` dep should not apply to `react-dom`, but got %v", args.deps)
+	}
+	args = newBuildArgs(Pkg{Name: "foo", Version: "1.0.0"}, deps)
+	if len(args.deps) != 1 || args.deps[0].Name != "react" {
+		t.Fatalf("the package itself should be excluded from the deps, but got %v", args.deps)
+	}
+
+	args.external.Add("bar")
+	args.conditions.Add("worker")
+	if stable := fixStableBuildArgs(args, Pkg{Name: "react", Version: "18.2.0"}); len(stable.deps) != 0 || stable.external.Len() != 0 || !stable.conditions.Has("worker") {
+		t.Fatal("the build args of the stable build should be cleared except the conditions")
+	}
+	if sub := fixStableBuildArgs(args, Pkg{Name: "react", Version: "18.2.0", Submodule: "jsx-runtime"}); sub.external.Len() != 1 {
+		t.Fatal("the build args of the stable submodule should be kept")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// BuildFailure is the record of a failed build task, the requests of the task get the
+// recorded error instead of rebuilding until the backoff expires.
+type BuildFailure struct {
+	Message   string `json:"error"`
+	Stage     string `json:"stage"`
+	Transient bool   `json:"transient,omitempty"`
+	Attempts  int    `json:"attempts"`
+	FailedAt  int64  `json:"failedAt"`
+	RetryAt   int64  `json:"retryAt"`
+}
+
+func (f *BuildFailure) Error() string {
+	return f.Message
+}
+
+const (
+	// the max times to retry a build that fails with a transient error
+	buildRetries = 3
+	// the delay before the first retry, it's doubled for every retry
+	buildRetryDelay = 2 * time.Second
+	// the backoff of the failed build, it's doubled for every failure of the same task
+	failureBackoff          = time.Minute
+	transientFailureBackoff = 10 * time.Second
+	maxFailureBackoff       = 6 * time.Hour
+	// keep the failure record longer than the backoff to count the attempts
+	failureRecordTTL = 24 * time.Hour
+)
+
+// transientErrors are the messages of the network errors, mostly reported by `pnpm` or the npm registry.
+var transientErrors = []string{
+	"ECONNRESET",
+	"ECONNREFUSED",
+	"ETIMEDOUT",
+	"EAI_AGAIN",
+	"ENETUNREACH",
+	"socket hang up",
+	"connection reset by peer",
+	"connection refused",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+	"429 Too Many Requests",
+}
+
+// isTransientError checks if the build error may be fixed by retrying, e.g. a network error.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFailure returns the failure record of the task, or nil if the task hasn't failed recently.
+func (q *BuildQueue) loadFailure(id string) *BuildFailure {
+	if q.failures == nil {
+		return nil
+	}
+	data, err := q.failures.Get("build-failure:" + id)
+	if err != nil {
+		return nil
+	}
+	var f BuildFailure
+	if json.Unmarshal(data, &f) != nil {
+		return nil
+	}
+	return &f
+}
+
+// recordFailure records the failure of the task, the backoff grows with the failed attempts.
+func (q *BuildQueue) recordFailure(t *queueTask, err error) {
+	if q.failures == nil {
+		return
+	}
+	now := time.Now()
+	f := &BuildFailure{
+		Message:   err.Error(),
+		Stage:     t.stage,
+		Transient: isTransientError(err),
+		Attempts:  1,
+		FailedAt:  now.UnixMilli(),
+	}
+	if prev := q.loadFailure(t.ID()); prev != nil {
+		f.Attempts = prev.Attempts + 1
+	}
+	backoff := failureBackoff
+	if f.Transient {
+		backoff = transientFailureBackoff
+	}
+	for i := 1; i < f.Attempts && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailureBackoff {
+		backoff = maxFailureBackoff
+	}
+	f.RetryAt = now.Add(backoff).UnixMilli()
+	data, err := json.Marshal(f)
+	if err == nil {
+		err = q.failures.Set("build-failure:"+t.ID(), data, failureRecordTTL)
+	}
+	if err != nil {
+		log.Warnf("record build failure '%s': %v", t.ID(), err)
+	}
+}
+
+func (q *BuildQueue) clearFailure(id string) {
+	if q.failures != nil {
+		q.failures.Delete("build-failure:" + id)
+	}
+}
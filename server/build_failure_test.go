@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestIsTransientError(t *testing.T) {
+	for _, err := range []error{
+		errors.New("pnpm add: ERR_PNPM_META_FETCH_FAIL GET https://registry.npmjs.org/react: request to https://registry.npmjs.org/react failed, reason: socket hang up"),
+		errors.New("fetch: read tcp 10.0.0.1:443: connection reset by peer"),
+		fmt.Errorf("install: %w", context.DeadlineExceeded),
+	} {
+		if !isTransientError(err) {
+			t.Fatalf("'%v' should be transient", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		context.Canceled,
+		errors.New("Could not resolve \"./foo\""),
+		errors.New("npm: package 'foo' not found"),
+	} {
+		if isTransientError(err) {
+			t.Fatalf("'%v' should not be transient", err)
+		}
+	}
+}
+
+func TestBuildQueueFailure(t *testing.T) {
+	failures, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	q.failures = failures
+
+	task := newTestBuildTask("foo")
+	qt := &queueTask{BuildTask: task}
+	qt.stage = "install"
+	q.recordFailure(qt, errors.New("npm: package 'foo' not found"))
+
+	f := q.loadFailure(task.ID())
+	if f == nil || f.Stage != "install" || f.Attempts != 1 || f.Transient {
+		t.Fatalf("unexpected failure record: %v", f)
+	}
+	if d := time.Duration(f.RetryAt-f.FailedAt) * time.Millisecond; d != failureBackoff {
+		t.Fatalf("the backoff should be %v, but %v", failureBackoff, d)
+	}
+
+	// the recorded error is returned without rebuilding
+	c := q.Add(newTestBuildTask("foo"), "127.0.0.1")
+	select {
+	case output := <-c.C:
+		if output.err == nil || output.err.Error() != "npm: package 'foo' not found" {
+			t.Fatal("the recorded error should be returned, but", output.err)
+		}
+	default:
+		t.Fatal("the recorded error should be returned immediately")
+	}
+	if q.Len() != 0 {
+		t.Fatal("the failed task should not be queued")
+	}
+
+	// the backoff is doubled for every failure
+	q.recordFailure(qt, errors.New("npm: package 'foo' not found"))
+	f = q.loadFailure(task.ID())
+	if d := time.Duration(f.RetryAt-f.FailedAt) * time.Millisecond; f.Attempts != 2 || d != 2*failureBackoff {
+		t.Fatalf("the backoff should be %v, but %v", 2*failureBackoff, d)
+	}
+
+	// the task is queued after the failure is cleared
+	q.clearFailure(task.ID())
+	q.Add(newTestBuildTask("foo"), "127.0.0.1")
+	if q.Len() != 1 {
+		t.Fatal("the task should be queued")
+	}
+}
@@ -1,6 +1,12 @@
 package server
 
 import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,8 +14,11 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/utils"
 )
 
@@ -106,6 +115,34 @@ func (task *BuildTask) getBuildVersion(pkg Pkg) string {
 	return fmt.Sprintf("v%d", task.BuildVersion)
 }
 
+// context returns the context of the task, or a background context if the task is not started by `Build`.
+func (task *BuildTask) context() context.Context {
+	if task.ctx == nil {
+		return context.Background()
+	}
+	return task.ctx
+}
+
+// esbuild runs the esbuild with the options, the build is canceled when the context is done.
+func esbuild(ctx context.Context, options api.BuildOptions) api.BuildResult {
+	bctx, cerr := api.Context(options)
+	if cerr != nil {
+		return api.BuildResult{Errors: cerr.Errors}
+	}
+	defer bctx.Dispose()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			bctx.Cancel()
+		case <-done:
+		}
+	}()
+	return bctx.Rebuild()
+}
+
 func (task *BuildTask) getSavepath() string {
 	if stableBuild[task.Pkg.Name] {
 		return path.Join(fmt.Sprintf("builds/v%d", STABLE_VERSION), strings.TrimPrefix(task.ID(), "stable/"))
@@ -354,7 +391,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 				pkgs[i] = n + "@" + v
 				i++
 			}
-			err = pnpmInstall(wd, pkgs...)
+			err = pnpmInstall(task.context(), wd, pkgs...)
 			if err != nil {
 				return
 			}
@@ -624,15 +661,23 @@ func queryESMBuild(id string) (*ESMBuild, bool) {
 		var esm ESMBuild
 		err = json.Unmarshal(value, &esm)
 		if err == nil {
+			savePath := path.Join("builds", id)
 			if strings.HasPrefix(id, "stable/") {
-				id = fmt.Sprintf("v%d/", STABLE_VERSION) + strings.TrimPrefix(id, "stable/")
+				savePath = path.Join("builds", fmt.Sprintf("v%d", STABLE_VERSION), strings.TrimPrefix(id, "stable/"))
 			}
 			if !esm.TypesOnly {
-				_, err = fs.Stat(path.Join("builds", id))
+				_, err = fs.Stat(savePath)
+				if err == nil {
+					err = verifyArtifact(savePath, esm.Checksums[savePath])
+				}
 			}
 			if err == nil || os.IsExist(err) {
 				return &esm, true
 			}
+			if err == errChecksumMismatch {
+				log.Errorf("build '%s' is corrupted: checksum mismatch of '%s'", id, savePath)
+				deleteArtifacts(&esm)
+			}
 		}
 		// delete the invalid db entry
 		db.Delete(id)
@@ -640,6 +685,264 @@ func queryESMBuild(id string) (*ESMBuild, bool) {
 	return nil, false
 }
 
+// findESMBuildByArtifact finds the build record that the artifact belongs to by its save path,
+// e.g. "builds/v127/react@18.2.0/es2022/react.mjs.map" belongs to "v127/react@18.2.0/es2022/react.mjs".
+func findESMBuildByArtifact(savePath string) (id string, esm *ESMBuild) {
+	name := strings.TrimPrefix(savePath, "builds/")
+	names := []string{name}
+	if strings.HasSuffix(name, ".map") {
+		names = []string{strings.TrimSuffix(name, ".map")}
+	} else if strings.HasSuffix(name, ".css") {
+		base := strings.TrimSuffix(name, ".css")
+		names = []string{base + ".mjs", base + ".js"}
+	}
+	stablePrefix := fmt.Sprintf("v%d/", STABLE_VERSION)
+	for _, name := range names {
+		ids := []string{name}
+		if strings.HasPrefix(name, stablePrefix) {
+			ids = append(ids, "stable/"+strings.TrimPrefix(name, stablePrefix))
+		}
+		for _, id := range ids {
+			value, err := db.Get(id)
+			if err == nil && value != nil {
+				var m ESMBuild
+				if json.Unmarshal(value, &m) == nil {
+					return id, &m
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// the max number of the cached verified artifacts
+const verifiedArtifactsMax = 10000
+
+// verified artifacts, to avoid reading the file and the build record repeatly
+var verifiedArtifacts = newArtifactCache(verifiedArtifactsMax)
+
+// the negative result of the record lookup is cached for a while, the record may be stored after
+// the artifact is written by other processes
+const unrecordedArtifactTTL = time.Minute
+
+// verifiedArtifact is the checksum and the SRI hash of a verified artifact.
+type verifiedArtifact struct {
+	checksum  string
+	integrity string
+	// the artifact is checked with the record that it belongs to
+	recorded bool
+	// the expiry time of the artifact that has no record
+	expires time.Time
+}
+
+// checked returns true if the artifact is checked with its record and the result is not expired.
+func (a verifiedArtifact) checked() bool {
+	return a.recorded && (a.expires.IsZero() || time.Now().Before(a.expires))
+}
+
+// artifactCache is a LRU cache of the verified artifacts.
+type artifactCache struct {
+	lock  sync.Mutex
+	max   int
+	lru   *list.List
+	index map[string]*list.Element
+}
+
+type artifactCacheEntry struct {
+	savePath string
+	verifiedArtifact
+}
+
+func newArtifactCache(max int) *artifactCache {
+	return &artifactCache{
+		max:   max,
+		lru:   list.New(),
+		index: map[string]*list.Element{},
+	}
+}
+
+func (c *artifactCache) Load(savePath string) (verifiedArtifact, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.index[savePath]
+	if !ok {
+		return verifiedArtifact{}, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*artifactCacheEntry).verifiedArtifact, true
+}
+
+func (c *artifactCache) Store(savePath string, a verifiedArtifact) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.index[savePath]; ok {
+		el.Value.(*artifactCacheEntry).verifiedArtifact = a
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.index[savePath] = c.lru.PushFront(&artifactCacheEntry{savePath, a})
+	for c.lru.Len() > c.max {
+		delete(c.index, c.lru.Remove(c.lru.Back()).(*artifactCacheEntry).savePath)
+	}
+}
+
+func (c *artifactCache) Delete(savePath string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.index[savePath]; ok {
+		c.lru.Remove(el)
+		delete(c.index, savePath)
+	}
+}
+
+// writeArtifact writes the build artifact to the storage and records its SHA-256 checksum and
+// SRI hash.
+func (task *BuildTask) writeArtifact(savePath string, r io.Reader) (err error) {
+	h := sha256.New()
+	sri := sha512.New384()
+	_, err = fs.WriteFile(savePath, io.TeeReader(r, io.MultiWriter(h, sri)))
+	if err != nil {
+		return
+	}
+	a := verifiedArtifact{
+		checksum:  hex.EncodeToString(h.Sum(nil)),
+		integrity: "sha384-" + base64.StdEncoding.EncodeToString(sri.Sum(nil)),
+		recorded:  true,
+	}
+	verifiedArtifacts.Store(savePath, a)
+	if task.checksums != nil {
+		task.checksums.Set(savePath, a.checksum)
+	}
+	if task.integrity != nil {
+		task.integrity.Set(savePath, a.integrity)
+	}
+	// the types are shared by the builds, record the checksum by the save path
+	if strings.HasPrefix(savePath, "types/") {
+		err = db.Put(savePath, []byte(a.checksum))
+	}
+	return
+}
+
+// getBuildIntegrity returns the SRI hash of the build file, e.g. "sha384-...", the hash is computed
+// from the file if it's not recorded in the build(e.g. the builds before the integrity is added).
+func getBuildIntegrity(id string, esm *ESMBuild) (string, error) {
+	savePath := path.Join("builds", id)
+	if strings.HasPrefix(id, "stable/") {
+		savePath = path.Join("builds", fmt.Sprintf("v%d", STABLE_VERSION), strings.TrimPrefix(id, "stable/"))
+	}
+	if esm != nil && esm.Integrity[savePath] != "" {
+		return esm.Integrity[savePath], nil
+	}
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha512.New384()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyArtifact checks the SHA-256 checksum of the stored artifact, an empty checksum is always valid.
+func verifyArtifact(savePath string, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if a, ok := verifiedArtifacts.Load(savePath); ok && a.checksum == checksum {
+		return nil
+	}
+	r, err := fs.OpenFile(savePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		verifiedArtifacts.Delete(savePath)
+		return errChecksumMismatch
+	}
+	verifiedArtifacts.Store(savePath, verifiedArtifact{checksum: checksum})
+	return nil
+}
+
+// verifyBuildArtifact verifies the artifact by the build record that it belongs to, the corrupted
+// build is deleted. The result is cached, so the build record is not loaded for every request.
+func verifyBuildArtifact(savePath string) (a verifiedArtifact, err error) {
+	if a, ok := verifiedArtifacts.Load(savePath); ok && a.checked() {
+		return a, nil
+	}
+	id, esm := findESMBuildByArtifact(savePath)
+	if esm == nil {
+		verifiedArtifacts.Store(savePath, verifiedArtifact{recorded: true, expires: time.Now().Add(unrecordedArtifactTTL)})
+		return
+	}
+	a = verifiedArtifact{checksum: esm.Checksums[savePath], integrity: esm.Integrity[savePath], recorded: true}
+	err = verifyArtifact(savePath, a.checksum)
+	if err == errChecksumMismatch {
+		log.Errorf("build '%s' is corrupted: checksum mismatch of '%s'", id, savePath)
+		deleteArtifacts(esm)
+		db.Delete(id)
+		return
+	}
+	if err == nil {
+		verifiedArtifacts.Store(savePath, a)
+	}
+	return
+}
+
+// verifyTypesArtifact verifies the types artifact by the checksum that is recorded by the save path,
+// the corrupted artifact is deleted.
+func verifyTypesArtifact(savePath string) (err error) {
+	if a, ok := verifiedArtifacts.Load(savePath); ok && a.checked() {
+		return nil
+	}
+	value, err := db.Get(savePath)
+	if err != nil {
+		return
+	}
+	if value == nil {
+		verifiedArtifacts.Store(savePath, verifiedArtifact{recorded: true, expires: time.Now().Add(unrecordedArtifactTTL)})
+		return
+	}
+	err = verifyArtifact(savePath, string(value))
+	if err == errChecksumMismatch {
+		log.Errorf("types '%s' is corrupted: checksum mismatch", savePath)
+		fs.Delete(savePath)
+		db.Delete(savePath)
+		return
+	}
+	if err == nil {
+		verifiedArtifacts.Store(savePath, verifiedArtifact{checksum: string(value), recorded: true})
+	}
+	return
+}
+
+// deleteArtifacts deletes all the artifacts of the build from the storage.
+func deleteArtifacts(esm *ESMBuild) {
+	for savePath := range esm.Checksums {
+		verifiedArtifacts.Delete(savePath)
+		err := fs.Delete(savePath)
+		if err != nil {
+			log.Errorf("fs.Delete(%s): %v", savePath, err)
+		}
+		if strings.HasPrefix(savePath, "types/") {
+			db.Delete(savePath)
+		}
+	}
+}
+
 var esmExts = []string{".mjs", ".js", ".jsx", ".mts", ".ts", ".tsx"}
 
 func resolveESModule(wd string, packageName string, moduleSpecifier string) (resolvedName string, namedExports []string, err error) {
@@ -689,7 +992,8 @@ func resolveESModule(wd string, packageName string, moduleSpecifier string) (res
 func copyRawBuildFile(id string, name string, dir string) (err error) {
 	var r io.ReadCloser
 	var f *os.File
-	r, err = fs.OpenFile(path.Join("publish", strings.TrimPrefix(id, "~"), name))
+	savePath := path.Join("publish", strings.TrimPrefix(id, "~"), name)
+	r, err = fs.OpenFile(savePath)
 	if err != nil {
 		if err == storage.ErrNotFound {
 			return nil
@@ -703,6 +1007,21 @@ func copyRawBuildFile(id string, name string, dir string) (err error) {
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, r)
+	h := sha256.New()
+	_, err = io.Copy(f, io.TeeReader(r, h))
+	if err != nil {
+		return
+	}
+
+	// verify the checksum recorded by the publish API
+	var record struct {
+		Checksums map[string]string `json:"checksums"`
+	}
+	value, err := db.Get("publish-" + strings.TrimPrefix(id, "~"))
+	if err == nil && value != nil && json.Unmarshal(value, &record) == nil {
+		if checksum := record.Checksums[savePath]; checksum != "" && checksum != hex.EncodeToString(h.Sum(nil)) {
+			return fmt.Errorf("%s: %v", savePath, errChecksumMismatch)
+		}
+	}
 	return
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+func TestArtifactChecksum(t *testing.T) {
+	var err error
+	dir := t.TempDir()
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	log, _ = logx.New("")
+
+	task := &BuildTask{checksums: newStringMap(), integrity: newStringMap()}
+	id := "v1/foo@1.0.0/es2022/foo.mjs"
+	savePath := "builds/" + id
+	err = task.writeArtifact(savePath, strings.NewReader("export default 'foo'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = task.writeArtifact(savePath+".map", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := task.checksums.Map()
+	if len(checksums[savePath]) != 64 || len(checksums) != 2 {
+		t.Fatalf("invalid checksums %v", checksums)
+	}
+	err = verifyArtifact(savePath, checksums[savePath])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	integrity := task.integrity.Map()
+	if !strings.HasPrefix(integrity[savePath], "sha384-") || len(integrity) != 2 {
+		t.Fatalf("invalid integrity %v", integrity)
+	}
+	// the integrity computed from the file should be the same
+	if sri, err := getBuildIntegrity(id, nil); err != nil || sri != integrity[savePath] {
+		t.Fatalf("the integrity should be '%s', but '%s'", integrity[savePath], sri)
+	}
+
+	data, _ := json.Marshal(&ESMBuild{Checksums: checksums})
+	db.Put(id, data)
+
+	if _, ok := queryESMBuild(id); !ok {
+		t.Fatal("the build should be found")
+	}
+	if mid, esm := findESMBuildByArtifact(savePath + ".map"); mid != id || esm == nil {
+		t.Fatalf("the build of the source map should be '%s', but '%s'", id, mid)
+	}
+	if a, err := verifyBuildArtifact(savePath); err != nil || a.checksum != checksums[savePath] {
+		t.Fatal("the artifact should be verified by the build record", err)
+	}
+
+	// corrupt the artifact
+	verifiedArtifacts.Delete(savePath)
+	_, err = fs.WriteFile(savePath, strings.NewReader("export default 'bar'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyArtifact(savePath, checksums[savePath])
+	if err != errChecksumMismatch {
+		t.Fatal("should be checksum mismatch error, but", err)
+	}
+	if _, ok := queryESMBuild(id); ok {
+		t.Fatal("the corrupted build should not be found")
+	}
+	for p := range checksums {
+		if _, err := fs.Stat(p); err != storage.ErrNotFound {
+			t.Fatalf("'%s' should be deleted", p)
+		}
+	}
+	if value, _ := db.Get(id); value != nil {
+		t.Fatal("the corrupted build record should be deleted")
+	}
+}
+
+func TestArtifactCache(t *testing.T) {
+	c := newArtifactCache(2)
+	c.Store("a", verifiedArtifact{checksum: "a"})
+	c.Store("b", verifiedArtifact{checksum: "b"})
+	c.Load("a")
+	c.Store("c", verifiedArtifact{checksum: "c"})
+	if _, ok := c.Load("b"); ok {
+		t.Fatal("the least recently used entry should be evicted")
+	}
+	if a, ok := c.Load("a"); !ok || a.checksum != "a" {
+		t.Fatal("the recently used entry should be kept")
+	}
+	c.Delete("a")
+	if _, ok := c.Load("a"); ok || c.lru.Len() != 1 {
+		t.Fatal("the entry should be deleted")
+	}
+}
+
+func TestTypesArtifactChecksum(t *testing.T) {
+	var err error
+	dir := t.TempDir()
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	log, _ = logx.New("")
+
+	task := &BuildTask{checksums: newStringMap(), integrity: newStringMap()}
+	savePath := "types/esm.sh/v1/foo@1.0.0/index.d.ts"
+	err = task.writeArtifact(savePath, strings.NewReader("export {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get(savePath); string(value) != task.checksums.Map()[savePath] {
+		t.Fatal("the checksum of the types should be recorded")
+	}
+	if err = verifyTypesArtifact(savePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the types
+	verifiedArtifacts.Delete(savePath)
+	fs.WriteFile(savePath, strings.NewReader("export default 1"))
+	if err = verifyTypesArtifact(savePath); err != errChecksumMismatch {
+		t.Fatal("should be checksum mismatch error, but", err)
+	}
+	if _, err = fs.Stat(savePath); err != storage.ErrNotFound {
+		t.Fatal("the corrupted types should be deleted")
+	}
+
+	// the artifact without record is cached
+	unknown := "builds/v1/bar@1.0.0/es2022/bar.mjs"
+	if _, err = verifyBuildArtifact(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := verifiedArtifacts.Load(unknown); !ok || !a.checked() || a.checksum != "" {
+		t.Fatal("the negative lookup should be cached")
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// BuildEvent is a progress event of a build task.
+type BuildEvent struct {
+	// one of "stage", "position", "rebuild", "done" and "error"
+	Type  string `json:"type"`
+	Stage string `json:"stage,omitempty"`
+	// the position of the pending task in the queue, starts from 1
+	Position int `json:"position,omitempty"`
+	// the module that is marked as external implicitly and causes a rebuild
+	External string    `json:"external,omitempty"`
+	ESM      *ESMBuild `json:"esm,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     int64     `json:"time"`
+}
+
+// buildProgress broadcasts the progress events of a build task to the watchers.
+type buildProgress struct {
+	lock     sync.Mutex
+	watchers map[chan BuildEvent]struct{}
+	stage    *BuildEvent
+	position int
+	result   *BuildEvent
+}
+
+func newBuildProgress() *buildProgress {
+	return &buildProgress{watchers: map[chan BuildEvent]struct{}{}}
+}
+
+func (p *buildProgress) emit(e BuildEvent) {
+	e.Time = time.Now().UnixMilli()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.result != nil {
+		return
+	}
+	switch e.Type {
+	case "stage":
+		p.stage = &e
+	case "position":
+		if e.Position == p.position {
+			return
+		}
+		p.position = e.Position
+	case "done", "error":
+		p.result = &e
+	}
+	for c := range p.watchers {
+		select {
+		case c <- e:
+		default:
+			// drop the event for the slow watcher, the result is always available after the channel is closed
+		}
+	}
+	if p.result != nil {
+		for c := range p.watchers {
+			close(c)
+		}
+		p.watchers = nil
+	}
+}
+
+// watch returns a channel that receives the events, the channel is closed after the task is done.
+// The current stage and position are sent to the channel first.
+func (p *buildProgress) watch() (chan BuildEvent, func()) {
+	c := make(chan BuildEvent, 64)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.result != nil {
+		close(c)
+		return c, func() {}
+	}
+	if p.stage != nil {
+		c <- *p.stage
+	}
+	if p.position > 0 {
+		c <- BuildEvent{Type: "position", Position: p.position, Time: time.Now().UnixMilli()}
+	}
+	p.watchers[c] = struct{}{}
+	return c, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if _, ok := p.watchers[c]; ok {
+			delete(p.watchers, c)
+			close(c)
+		}
+	}
+}
+
+// watched returns true if the progress has watchers.
+func (p *buildProgress) watched() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.watchers) > 0
+}
+
+func (p *buildProgress) getResult() *BuildEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.result
+}
+
+// setStage sets the stage of the task and reports it to the progress watchers.
+func (task *BuildTask) setStage(stage string) {
+	task.stage = stage
+	task.emit(BuildEvent{Type: "stage", Stage: stage})
+}
+
+func (task *BuildTask) emit(e BuildEvent) {
+	if task.progress != nil {
+		task.progress.emit(e)
+	}
+}
+
+// emitPositions reports the positions of the pending tasks that are watched, the position is the
+// number of the pending tasks that are picked before the task, see `pick`.
+func (q *BuildQueue) emitPositions() {
+	type watchedTask struct {
+		progress *buildProgress
+		priority BuildPriority
+		// the number of the pending tasks of the same priority before the task
+		index int
+	}
+
+	now := time.Now()
+	counts := map[BuildPriority]int{}
+	watched := []watchedTask{}
+
+	q.lock.RLock()
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if !ok || t.inProcess {
+			continue
+		}
+		p := t.effectivePriority(now)
+		if t.progress != nil && t.progress.watched() {
+			watched = append(watched, watchedTask{t.progress, p, counts[p]})
+		}
+		counts[p]++
+	}
+	q.lock.RUnlock()
+
+	for _, t := range watched {
+		position := t.index + 1
+		for p, n := range counts {
+			if p < t.priority {
+				position += n
+			}
+		}
+		t.progress.emit(BuildEvent{Type: "position", Position: position})
+	}
+}
+
+// progressHandler streams the progress events of the build task, in SSE format by default,
+// or in NDJSON format if the `?format=ndjson` query or the `Accept: application/x-ndjson` header is set.
+func progressHandler(ctx *rex.Context, id string) interface{} {
+	var progress *buildProgress
+	buildQueue.lock.RLock()
+	t, ok := buildQueue.tasks[id]
+	if ok {
+		progress = t.progress
+	}
+	buildQueue.lock.RUnlock()
+
+	var result *BuildEvent
+	if progress == nil {
+		if esm, ok := queryESMBuild(id); ok {
+			result = &BuildEvent{Type: "done", ESM: esm, Time: time.Now().UnixMilli()}
+		} else if f := buildQueue.loadFailure(id); f != nil {
+			result = &BuildEvent{Type: "error", Stage: f.Stage, Error: f.Message, Time: f.FailedAt}
+		} else {
+			return rex.Status(404, "build not found")
+		}
+	}
+
+	ndjson := ctx.Form.Value("format") == "ndjson" || strings.Contains(ctx.R.Header.Get("Accept"), "application/x-ndjson")
+	writeEvent := func(w io.Writer, e *BuildEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if ndjson {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		return err
+	}
+
+	contentType := "text/event-stream"
+	if ndjson {
+		contentType = "application/x-ndjson"
+	}
+	header := ctx.W.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "private, no-store, no-cache, must-revalidate")
+
+	if result != nil {
+		buf := strings.Builder{}
+		writeEvent(&buf, result)
+		return buf.String()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the rex response writer can't be flushed, hijack the connection to stream the events
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusNotImplemented)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			// e.g. http/2
+			http.Error(w, "streaming unsupported: "+err.Error(), http.StatusNotImplemented)
+			return
+		}
+		defer conn.Close()
+
+		header.Del("Content-Length")
+		header.Set("Connection", "close")
+		fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\n")
+		header.Write(rw)
+		fmt.Fprintf(rw, "\r\n")
+		if rw.Flush() != nil {
+			return
+		}
+
+		c, stop := progress.watch()
+		defer stop()
+		// the positions are only reported to the watched tasks
+		buildQueue.emitPositions()
+
+		ping := time.NewTicker(15 * time.Second)
+		defer ping.Stop()
+		flush := func(w *bufio.ReadWriter, e *BuildEvent) bool {
+			return writeEvent(w, e) == nil && w.Flush() == nil
+		}
+		for {
+			select {
+			case e, ok := <-c:
+				if !ok {
+					if result := progress.getResult(); result != nil {
+						flush(rw, result)
+					}
+					return
+				}
+				if e.Type == "done" || e.Type == "error" {
+					flush(rw, &e)
+					return
+				}
+				if !flush(rw, &e) {
+					return
+				}
+			case <-ping.C:
+				if ndjson {
+					continue
+				}
+				// keep the connection alive and detect the closed connection
+				if _, err := fmt.Fprintf(rw, ": ping\n\n"); err != nil || rw.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+}
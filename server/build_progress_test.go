@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ije/rex"
+)
+
+func TestBuildProgress(t *testing.T) {
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	defer func(q *BuildQueue) { buildQueue = q }(buildQueue)
+	buildQueue = q
+
+	foo := newTestBuildTask("foo")
+	bar := newTestBuildTask("bar")
+	c := q.Add(foo, "127.0.0.1")
+	q.Add(bar, "127.0.0.1")
+
+	h := &rex.Handler{}
+	h.Use(func(ctx *rex.Context) interface{} {
+		return progressHandler(ctx, bar.ID())
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?format=ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("unexpected content type '%s'", ct)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	next := func() (e BuildEvent) {
+		if !scanner.Scan() {
+			t.Fatal("unexpected end of the stream")
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if e := next(); e.Type != "stage" || e.Stage != "pending" {
+		t.Fatalf("unexpected event %v", e)
+	}
+	if e := next(); e.Type != "position" || e.Position != 2 {
+		t.Fatalf("unexpected event %v", e)
+	}
+
+	// the previous task is removed
+	q.RemoveConsumer(foo, c)
+	if e := next(); e.Type != "position" || e.Position != 1 {
+		t.Fatalf("unexpected event %v", e)
+	}
+
+	bar.setStage("install")
+	if e := next(); e.Type != "stage" || e.Stage != "install" {
+		t.Fatalf("unexpected event %v", e)
+	}
+	bar.emit(BuildEvent{Type: "rebuild", External: "baz"})
+	if e := next(); e.Type != "rebuild" || e.External != "baz" {
+		t.Fatalf("unexpected event %v", e)
+	}
+	bar.emit(BuildEvent{Type: "done", ESM: &ESMBuild{Dts: "bar.d.ts"}})
+	if e := next(); e.Type != "done" || e.ESM == nil || e.ESM.Dts != "bar.d.ts" {
+		t.Fatalf("unexpected event %v", e)
+	}
+	if scanner.Scan() {
+		t.Fatal("the stream should be closed after the task is done")
+	}
+}
+
+func TestEmitPositions(t *testing.T) {
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	prewarm := newTestBuildTask("prewarm")
+	background := newTestBuildTask("background")
+	interactive := newTestBuildTask("interactive")
+	q.AddWithPriority(prewarm, "", PriorityPrewarm)
+	q.AddWithPriority(background, "", PriorityBackground)
+	q.AddWithPriority(interactive, "127.0.0.1", PriorityInteractive)
+
+	c1, stop1 := prewarm.progress.watch()
+	defer stop1()
+	c2, stop2 := interactive.progress.watch()
+	defer stop2()
+	q.emitPositions()
+
+	for _, w := range []struct {
+		c        chan BuildEvent
+		position int
+	}{{c1, 3}, {c2, 1}} {
+		var e BuildEvent
+		for e = range w.c {
+			if e.Type == "position" {
+				break
+			}
+		}
+		if e.Position != w.position {
+			t.Fatalf("the position should be %d, but got %d", w.position, e.Position)
+		}
+	}
+	if background.progress.position != 0 {
+		t.Fatal("the position should not be computed for the task that is not watched")
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// the interval that the async clients should poll the build status
+const asyncRetryAfter = 2
+
+// isAsyncRequest checks if the client wants the async build mode by the `?async` query
+// or the `Prefer: respond-async` header.
+func isAsyncRequest(ctx *rex.Context) bool {
+	if ctx.Form.Has("async") {
+		return true
+	}
+	for _, v := range ctx.R.Header.Values("Prefer") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == "respond-async" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildAsync adds the task to the queue and returns `202 Accepted` with the status URL immediately,
+// the task is built even if the client goes away since the consumer is never removed.
+func buildAsync(ctx *rex.Context, cdnOrigin string, task *BuildTask) interface{} {
+	c := buildQueue.Add(task, ctx.RemoteIP())
+	select {
+	case output := <-c.C:
+		// the task failed recently or the client has too many builds
+		if output.err != nil {
+			return throwErrorJS(ctx, output.err)
+		}
+	default:
+	}
+
+	statusUrl := fmt.Sprintf("%s%s/_status/%s", cdnOrigin, cfg.BasePath, task.ID())
+	ctx.SetHeader("Location", statusUrl)
+	ctx.SetHeader("Retry-After", fmt.Sprintf("%d", asyncRetryAfter))
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+	return rex.Status(http.StatusAccepted, map[string]interface{}{
+		"id":        task.ID(),
+		"status":    "queued",
+		"statusUrl": statusUrl,
+	})
+}
+
+// buildStatusHandler reports the status of the build task: "queued", "building", "done" or "failed",
+// it redirects to the build file once the build is stored.
+func buildStatusHandler(ctx *rex.Context, cdnOrigin string, id string) interface{} {
+	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+
+	status := getBuildStatus(id)
+	if status == nil {
+		return rex.Status(404, "build not found")
+	}
+	switch status["status"] {
+	case "done":
+		return rex.Redirect(fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.BasePath, id), http.StatusSeeOther)
+	case "queued", "building":
+		ctx.SetHeader("Retry-After", fmt.Sprintf("%d", asyncRetryAfter))
+	}
+	return status
+}
+
+// getBuildStatus returns the status of the build task, or nil if the task is not found.
+func getBuildStatus(id string) map[string]interface{} {
+	status := map[string]interface{}{"id": id}
+	buildQueue.lock.RLock()
+	t, ok := buildQueue.tasks[id]
+	if ok {
+		if t.inProcess {
+			status["status"] = "building"
+			status["stage"] = t.stage
+			status["startedAt"] = t.startedAt.Format(http.TimeFormat)
+		} else {
+			status["status"] = "queued"
+		}
+		status["createdAt"] = t.createdAt.Format(http.TimeFormat)
+	}
+	buildQueue.lock.RUnlock()
+
+	if ok {
+		return status
+	}
+
+	if _, ok := queryESMBuild(id); ok {
+		status["status"] = "done"
+		return status
+	}
+
+	if f := buildQueue.loadFailure(id); f != nil {
+		status["status"] = "failed"
+		status["stage"] = f.Stage
+		status["error"] = f.Message
+		status["failedAt"] = time.UnixMilli(f.FailedAt).UTC().Format(http.TimeFormat)
+		return status
+	}
+
+	return nil
+}
+
+// buildMetaHandler returns the metadata of the build, including the SRI hashes of the build files
+// that can be used as the `integrity` attributes.
+func buildMetaHandler(ctx *rex.Context, cdnOrigin string, id string) interface{} {
+	esm, ok := queryESMBuild(id)
+	if !ok {
+		return rex.Status(404, "build not found")
+	}
+
+	url := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.BasePath, id)
+	meta := map[string]interface{}{
+		"id":  id,
+		"url": url,
+	}
+	if !esm.TypesOnly {
+		integrity, err := getBuildIntegrity(id, esm)
+		if err != nil {
+			return rex.Status(500, err.Error())
+		}
+		meta["integrity"] = integrity
+	}
+	files := map[string]string{}
+	for savePath, integrity := range esm.Integrity {
+		name := strings.TrimPrefix(savePath, "builds/")
+		if name == savePath {
+			// e.g. the types
+			continue
+		}
+		if strings.HasPrefix(id, "stable/") {
+			name = "stable/" + strings.TrimPrefix(name, fmt.Sprintf("v%d/", STABLE_VERSION))
+		}
+		files[fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.BasePath, name)] = integrity
+	}
+	meta["files"] = files
+	deps := make([]string, len(esm.Deps))
+	for i, dep := range esm.Deps {
+		if strings.HasPrefix(dep, "/") {
+			// the dep path contains the base path
+			dep = cdnOrigin + dep
+		}
+		deps[i] = dep
+	}
+	meta["deps"] = deps
+	if esm.Dts != "" {
+		meta["dts"] = fmt.Sprintf("%s%s%s", cdnOrigin, cfg.BasePath, esm.Dts)
+	}
+	ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
+	// the URLs are built with the origin that is set by the `X-Real-Origin` header, the request host
+	// is a part of the cache key already
+	ctx.AddHeader("Vary", "X-Real-Origin")
+	return meta
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/utils"
+	"github.com/ije/rex"
+)
+
+func TestAsyncBuild(t *testing.T) {
+	var err error
+	defer func(c *config.Config, d storage.DataBase, q *BuildQueue) {
+		cfg, db, buildQueue = c, d, q
+	}(cfg, db, buildQueue)
+	cfg = &config.Config{}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// no processes, the tasks are always pending
+	buildQueue = newBuildQueue(0)
+	buildQueue.failures, err = storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &rex.Handler{}
+	h.Use(func(ctx *rex.Context) interface{} {
+		pathname := ctx.Path.String()
+		if strings.HasPrefix(pathname, "/_status/") {
+			return buildStatusHandler(ctx, "https://esm.sh", strings.TrimPrefix(pathname, "/_status/"))
+		}
+		if !isAsyncRequest(ctx) {
+			return rex.Status(400, "not async")
+		}
+		return buildAsync(ctx, "https://esm.sh", newTestBuildTask(strings.TrimPrefix(pathname, "/")))
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	getStatus := func(id string) (status map[string]interface{}, res *http.Response) {
+		res, err := client.Get(server.URL + "/_status/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode == 200 {
+			json.NewDecoder(res.Body).Decode(&status)
+		}
+		return
+	}
+
+	id := newTestBuildTask("foo").ID()
+	res, err := client.Get(server.URL + "/foo?async")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if res.Header.Get("Location") != "https://esm.sh/_status/"+id || res.Header.Get("Retry-After") != "2" {
+		t.Fatalf("unexpected headers %v", res.Header)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/bar", nil)
+	req.Header.Set("Prefer", "wait=10, respond-async")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("the 'Prefer: respond-async' header should enable the async mode, but got status %d", res.StatusCode)
+	}
+
+	if status, _ := getStatus(id); status["status"] != "queued" {
+		t.Fatalf("unexpected status %v", status)
+	}
+	buildQueue.tasks[id].inProcess = true
+	buildQueue.tasks[id].stage = "install"
+	if status, _ := getStatus(id); status["status"] != "building" || status["stage"] != "install" {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	// done
+	delete(buildQueue.tasks, id)
+	// a types only build has no build file to check
+	db.Put(id, []byte(`{"o":true}`))
+	if _, res := getStatus(id); res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "https://esm.sh/"+id {
+		t.Fatalf("should redirect to the build file, but got status %d", res.StatusCode)
+	}
+
+	// failed
+	task := newTestBuildTask("bar")
+	delete(buildQueue.tasks, task.ID())
+	buildQueue.recordFailure(&queueTask{BuildTask: task}, errors.New("oops"))
+	if status, _ := getStatus(task.ID()); status["status"] != "failed" || status["error"] != "oops" {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	if _, res := getStatus("v127/baz@1.0.0/es2022/baz.mjs"); res.StatusCode != 404 {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+}
+
+func TestBuildMeta(t *testing.T) {
+	var err error
+	defer func(c *config.Config, d storage.DataBase, f storage.FileSystem) {
+		cfg, db, fs = c, d, f
+	}(cfg, db, fs)
+	cfg = &config.Config{}
+	dir := t.TempDir()
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := newTestBuildTask("foo")
+	task.integrity = newStringMap()
+	id := task.ID()
+	savePath := task.getSavepath()
+	err = task.writeArtifact(savePath, strings.NewReader("export default 'foo'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put(id, utils.MustEncodeJSON(&ESMBuild{
+		Deps:      []string{"/v1/bar@1.0.0/es2022/bar.mjs"},
+		Integrity: task.integrity.Map(),
+	}))
+
+	h := &rex.Handler{}
+	h.Use(func(ctx *rex.Context) interface{} {
+		return buildMetaHandler(ctx, "https://esm.sh", strings.TrimPrefix(ctx.Path.String(), "/_meta/"))
+	})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL + "/_meta/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var meta struct {
+		URL       string            `json:"url"`
+		Integrity string            `json:"integrity"`
+		Files     map[string]string `json:"files"`
+		Deps      []string          `json:"deps"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Vary") != "X-Real-Origin" {
+		t.Fatalf("the meta should vary by the origin, but got vary '%s'", res.Header.Get("Vary"))
+	}
+	url := "https://esm.sh/" + id
+	if meta.URL != url || meta.Integrity == "" || meta.Files[url] != meta.Integrity {
+		t.Fatalf("unexpected meta %+v", meta)
+	}
+	if len(meta.Deps) != 1 || meta.Deps[0] != "https://esm.sh/v1/bar@1.0.0/es2022/bar.mjs" {
+		t.Fatalf("unexpected deps %v", meta.Deps)
+	}
+
+	res, err = server.Client().Get(server.URL + "/_meta/v1/baz@1.0.0/es2022/baz.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+type buildWorkerTask struct {
+	Args         BuildArgs `json:"args"`
+	Pkg          Pkg       `json:"pkg"`
+	CdnOrigin    string    `json:"cdnOrigin"`
+	Target       string    `json:"target"`
+	BuildVersion int       `json:"buildVersion"`
+	Dev          bool      `json:"dev"`
+	Bundle       bool      `json:"bundle"`
+}
+
+// toWorkerTask returns the serializable fields of the task that are passed to a build worker.
+func (task *BuildTask) toWorkerTask() *buildWorkerTask {
+	return &buildWorkerTask{
+		Args:         task.Args,
+		Pkg:          task.Pkg,
+		CdnOrigin:    task.CdnOrigin,
+		Target:       task.Target,
+		BuildVersion: task.BuildVersion,
+		Dev:          task.Dev,
+		Bundle:       task.Bundle,
+	}
+}
+
+// toBuildTask returns a new build task of the fields.
+func (t *buildWorkerTask) toBuildTask() *BuildTask {
+	return &BuildTask{
+		Args:         t.Args,
+		Pkg:          t.Pkg,
+		CdnOrigin:    t.CdnOrigin,
+		Target:       t.Target,
+		BuildVersion: t.BuildVersion,
+		Dev:          t.Dev,
+		Bundle:       t.Bundle,
+	}
+}
+
+type buildWorkerRequest struct {
+	Config *config.Config   `json:"config"`
+	Task   *buildWorkerTask `json:"task"`
+	// the db records that the build reads, e.g. the checksums of the published module
+	Records map[string][]byte `json:"records,omitempty"`
+}
+
+type buildWorkerResponse struct {
+	ESM        *ESMBuild         `json:"esm,omitempty"`
+	Deprecated string            `json:"deprecated,omitempty"`
+	Records    map[string][]byte `json:"records,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// buildInWorker runs the build in a child `esmd build-worker` process, the process is killed
+// if it uses more memory than `cfg.BuildWorkerMem`. The db records of the build are stored by
+// the main process, since the bolt db can't be opened by multiple processes.
+func (task *BuildTask) buildInWorker(ctx context.Context) (esm *ESMBuild, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	records := map[string][]byte{}
+	if task.Pkg.FromEsmsh {
+		key := "publish-" + strings.TrimPrefix(task.Pkg.Name, "~")
+		value, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			records[key] = value
+		}
+	}
+
+	req, err := json.Marshal(buildWorkerRequest{
+		Records: records,
+		Config:  cfg,
+		Task:    task.toWorkerTask(),
+	})
+	if err != nil {
+		return
+	}
+
+	task.setStage("worker")
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, exe, "build-worker")
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GOMEMLIMIT=%dMiB", cfg.BuildWorkerMem))
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	oomc := make(chan bool, 1)
+	go func() {
+		oomc <- watchProcessMemory(cmd.Process, int64(cfg.BuildWorkerMem)<<20, done)
+	}()
+	err = cmd.Wait()
+	close(done)
+	oom := <-oomc
+
+	// after the build worker exits, purge the installed packages like the builds in the main process
+	defer func(pkgVersionName string) {
+		v, loaded := purgeTimers.LoadAndDelete(pkgVersionName)
+		if loaded {
+			v.(*time.Timer).Stop()
+		}
+		toPurge(pkgVersionName, path.Join(cfg.WorkDir, "npm", pkgVersionName))
+	}(task.Pkg.VersionName())
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if oom {
+		return nil, fmt.Errorf("build worker: out of memory(%dMB)", cfg.BuildWorkerMem)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("build worker: %s", msg)
+	}
+
+	var res buildWorkerResponse
+	err = json.Unmarshal(stdout.Bytes(), &res)
+	if err != nil {
+		return nil, fmt.Errorf("build worker: bad response: %v", err)
+	}
+	for key, value := range res.Records {
+		err = db.Put(key, value)
+		if err != nil {
+			return
+		}
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	task.Deprecated = res.Deprecated
+	return res.ESM, nil
+}
+
+// watchProcessMemory kills the process if its RSS exceeds the limit until the done channel is closed,
+// only works on linux that has the `/proc` filesystem.
+func watchProcessMemory(p *os.Process, limit int64, done chan struct{}) (killed bool) {
+	statusFile := fmt.Sprintf("/proc/%d/status", p.Pid)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rss, err := readProcessRSS(statusFile)
+			if err != nil {
+				return
+			}
+			if rss > limit {
+				p.Kill()
+				return true
+			}
+		}
+	}
+}
+
+func readProcessRSS(statusFile string) (rss int64, err error) {
+	f, err := os.Open(statusFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "VmRSS:") {
+			// e.g. "VmRSS:	  123456 kB"
+			fields := strings.Fields(strings.TrimPrefix(line, "VmRSS:"))
+			if len(fields) > 0 {
+				kb, err := strconv.ParseInt(fields[0], 10, 64)
+				if err != nil {
+					return 0, err
+				}
+				return kb << 10, nil
+			}
+		}
+	}
+	return 0, errors.New("VmRSS not found")
+}
+
+// BuildWorker runs the `esmd build-worker` command that reads a build task from stdin
+// and writes the result to stdout.
+func BuildWorker() {
+	var req buildWorkerRequest
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil || req.Config == nil || req.Task == nil {
+		fmt.Fprintln(os.Stderr, "invalid build worker request")
+		os.Exit(1)
+	}
+
+	cfg = req.Config
+	log, err = logx.New(fmt.Sprintf("file:%s?buffer=32k", path.Join(cfg.LogDir, fmt.Sprintf("build-worker-v%d.log", VERSION))))
+	if err != nil {
+		log = &logx.Logger{}
+	}
+	log.SetLevelByName(cfg.LogLevel)
+	log.SetQuite(true)
+	defer log.FlushBuffer()
+
+	cache, err = storage.OpenCache(cfg.Cache)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init storage(cache,%s): %v\n", cfg.Cache, err)
+		os.Exit(1)
+	}
+	// the stale temp files are removed by the server
+	fs, err = storage.OpenFSNoInit(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init storage(fs,%s): %v\n", cfg.Storage, err)
+		os.Exit(1)
+	}
+	if !cfg.NoCompress {
+		fs = storage.NewCompressedFS(fs)
+	}
+	records := &recordDB{records: map[string][]byte{}, reads: req.Records}
+	db = records
+
+	task := req.Task.toBuildTask()
+	var res buildWorkerResponse
+	esm, err := task.safeBuild(context.Background())
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.ESM = esm
+		res.Deprecated = task.Deprecated
+	}
+	res.Records = records.records
+	json.NewEncoder(os.Stdout).Encode(res)
+}
+
+// recordDB records the writes of the build worker, the records are stored by the main process.
+type recordDB struct {
+	lock    sync.Mutex
+	records map[string][]byte
+	// the records that are passed by the main process
+	reads map[string][]byte
+}
+
+func (r *recordDB) Get(key string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if value, ok := r.records[key]; ok {
+		return value, nil
+	}
+	return r.reads[key], nil
+}
+
+func (r *recordDB) Put(key string, value []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records[key] = value
+	return nil
+}
+
+func (r *recordDB) Delete(key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.records, key)
+	delete(r.reads, key)
+	return nil
+}
+
+func (r *recordDB) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return errors.New("not supported")
+}
+
+func (r *recordDB) DeleteAll(prefix string) (int, error) {
+	return 0, errors.New("not supported")
+}
+
+func (r *recordDB) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSafeBuild(t *testing.T) {
+	defer func(fn func(*BuildTask, context.Context) (*ESMBuild, error)) { buildFunc = fn }(buildFunc)
+	buildFunc = func(task *BuildTask, ctx context.Context) (*ESMBuild, error) {
+		panic("boom")
+	}
+	task := &BuildTask{Pkg: Pkg{Name: "~foo", Version: "0.0.0", FromEsmsh: true}, id: "~foo/es2022/mod.mjs"}
+	_, err := task.safeBuild(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "panic: boom") {
+		t.Fatal("the panic should be recovered as an error, but", err)
+	}
+}
+
+func TestBuildWorkerTaskJSON(t *testing.T) {
+	task := &buildWorkerTask{
+		Args: BuildArgs{
+			alias:       map[string]string{"a": "b"},
+			deps:        PkgSlice{Pkg{Name: "c", Version: "1.0.0"}},
+			external:    newStringSet("d"),
+			treeShaking: newStringSet("e", "f"),
+			conditions:  newStringSet(),
+			keepNames:   true,
+		},
+		Pkg:    Pkg{Name: "react", Version: "18.2.0"},
+		Target: "es2022",
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v buildWorkerTask
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encodeBuildArgsPrefix(v.Args, v.Pkg, false) != encodeBuildArgsPrefix(task.Args, task.Pkg, false) {
+		t.Fatal("the build args should be same after the JSON round trip")
+	}
+	if v.Pkg != task.Pkg || v.Target != task.Target {
+		t.Fatalf("invalid task %+v", v)
+	}
+	if w := v.toBuildTask().toWorkerTask(); w.Pkg != task.Pkg || w.Target != task.Target || !w.Args.keepNames {
+		t.Fatalf("invalid task %+v", w)
+	}
+}
+
+func TestReadProcessRSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("no /proc filesystem")
+	}
+	rss, err := readProcessRSS("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss <= 0 {
+		t.Fatalf("invalid rss %d", rss)
+	}
+}
+
+func TestRecordDB(t *testing.T) {
+	r := &recordDB{records: map[string][]byte{}, reads: map[string][]byte{"publish-foo": []byte("{}")}}
+	if value, _ := r.Get("publish-foo"); string(value) != "{}" {
+		t.Fatal("the passed record should be read")
+	}
+	r.Put("foo", []byte("bar"))
+	if value, _ := r.Get("foo"); string(value) != "bar" {
+		t.Fatal("the written record should be read")
+	}
+	if len(r.records) != 1 {
+		t.Fatal("only the written records should be returned to the main process")
+	}
+}
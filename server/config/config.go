@@ -11,26 +11,33 @@ import (
 )
 
 type Config struct {
-	Port             uint16  `json:"port,omitempty"`
-	TlsPort          uint16  `json:"tlsPort,omitempty"`
-	NsPort           uint16  `json:"nsPort,omitempty"`
-	BuildConcurrency uint16  `json:"buildConcurrency,omitempty"`
-	BanList          BanList `json:"banList,omitempty"`
-	WorkDir          string  `json:"workDir,omitempty"`
-	Cache            string  `json:"cache,omitempty"`
-	Database         string  `json:"database,omitempty"`
-	Storage          string  `json:"storage,omitempty"`
-	LogLevel         string  `json:"logLevel,omitempty"`
-	LogDir           string  `json:"logDir,omitempty"`
-	Origin           string  `json:"origin,omitempty"`
-	BasePath         string  `json:"basePath,omitempty"`
-	NpmRegistry      string  `json:"npmRegistry,omitempty"`
-	NpmToken         string  `json:"npmToken,omitempty"`
-	NpmRegistryScope string  `json:"npmRegistryScope,omitempty"`
-	NpmUser          string  `json:"npmUser,omitempty"`
-	NpmPassword      string  `json:"npmPassword,omitempty"`
-	AuthSecret       string  `json:"authSecret,omitempty"`
-	NoCompress       bool    `json:"noCompress,omitempty"`
+	Port               uint16  `json:"port,omitempty"`
+	TlsPort            uint16  `json:"tlsPort,omitempty"`
+	NsPort             uint16  `json:"nsPort,omitempty"`
+	BuildConcurrency   uint16  `json:"buildConcurrency,omitempty"`
+	InstallConcurrency uint16  `json:"installConcurrency,omitempty"`
+	TypesConcurrency   uint16  `json:"typesConcurrency,omitempty"`
+	ClientMaxBuilds    uint16  `json:"clientMaxBuilds,omitempty"`
+	ClientMaxQueued    uint16  `json:"clientMaxQueued,omitempty"`
+	BanList            BanList `json:"banList,omitempty"`
+	WorkDir            string  `json:"workDir,omitempty"`
+	Cache              string  `json:"cache,omitempty"`
+	Database           string  `json:"database,omitempty"`
+	Storage            string  `json:"storage,omitempty"`
+	LogLevel           string  `json:"logLevel,omitempty"`
+	LogDir             string  `json:"logDir,omitempty"`
+	Origin             string  `json:"origin,omitempty"`
+	BasePath           string  `json:"basePath,omitempty"`
+	NpmRegistry        string  `json:"npmRegistry,omitempty"`
+	NpmToken           string  `json:"npmToken,omitempty"`
+	NpmRegistryScope   string  `json:"npmRegistryScope,omitempty"`
+	NpmUser            string  `json:"npmUser,omitempty"`
+	NpmPassword        string  `json:"npmPassword,omitempty"`
+	AuthSecret         string  `json:"authSecret,omitempty"`
+	NoCompress         bool    `json:"noCompress,omitempty"`
+	BuildWorker        bool    `json:"buildWorker,omitempty"`
+	BuildWorkerMem     uint32  `json:"buildWorkerMem,omitempty"`
+	BuildCoordinator   bool    `json:"buildCoordinator,omitempty"`
 }
 
 type BanList struct {
@@ -106,6 +113,15 @@ func Load(filename string) (*Config, error) {
 	if cfg.BuildConcurrency < 4 {
 		cfg.BuildConcurrency = 4
 	}
+	if cfg.InstallConcurrency == 0 {
+		cfg.InstallConcurrency = cfg.BuildConcurrency
+	}
+	if cfg.TypesConcurrency == 0 {
+		cfg.TypesConcurrency = cfg.BuildConcurrency / 2
+	}
+	if cfg.BuildWorker && cfg.BuildWorkerMem == 0 {
+		cfg.BuildWorkerMem = 2048
+	}
 	if cfg.Cache == "" {
 		cfg.Cache = "memory:default"
 	}
@@ -138,15 +154,17 @@ func Default() *Config {
 		buildConcurrency = 4
 	}
 	return &Config{
-		Port:             8080,
-		NsPort:           8088,
-		BuildConcurrency: uint16(buildConcurrency),
-		WorkDir:          workDir,
-		Cache:            "memory:default",
-		Database:         fmt.Sprintf("bolt:%s", path.Join(workDir, "esm.db")),
-		Storage:          fmt.Sprintf("local:%s", path.Join(workDir, "storage")),
-		LogDir:           path.Join(workDir, "log"),
-		LogLevel:         "info",
+		Port:               8080,
+		NsPort:             8088,
+		BuildConcurrency:   uint16(buildConcurrency),
+		InstallConcurrency: uint16(buildConcurrency),
+		TypesConcurrency:   uint16(buildConcurrency / 2),
+		WorkDir:            workDir,
+		Cache:              "memory:default",
+		Database:           fmt.Sprintf("bolt:%s", path.Join(workDir, "esm.db")),
+		Storage:            fmt.Sprintf("local:%s", path.Join(workDir, "storage")),
+		LogDir:             path.Join(workDir, "log"),
+		LogLevel:           "info",
 	}
 }
 
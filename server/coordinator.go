@@ -0,0 +1,286 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ije/rex"
+)
+
+// Coordinator hands the build tasks of the `BuildQueue` to the remote workers. A worker leases a task by
+// `POST /_worker/lease`, keeps the lease alive by `POST /_worker/heartbeat`, and reports the result by
+// `POST /_worker/complete`. The task is reassigned to another worker if the lease expires.
+type Coordinator struct {
+	lock        sync.Mutex
+	secret      string
+	leaseTTL    time.Duration
+	maxAttempts int
+	pending     *list.List
+	leases      map[string]*remoteJob
+	wakeup      chan struct{}
+	closed      chan struct{}
+}
+
+type remoteJob struct {
+	task      *buildWorkerTask
+	id        string
+	leaseID   string
+	workerID  string
+	expiresAt time.Time
+	attempts  int
+	el        *list.Element
+	done      chan *workerResult
+}
+
+type workerLeaseRequest struct {
+	WorkerID string `json:"workerId"`
+	// the max time(ms) to wait for a task
+	Wait int64 `json:"wait"`
+}
+
+type workerLease struct {
+	ID   string           `json:"id"`
+	TTL  int64            `json:"ttl"`
+	Task *buildWorkerTask `json:"task"`
+}
+
+type workerHeartbeat struct {
+	LeaseID string `json:"leaseId"`
+}
+
+type workerResult struct {
+	LeaseID string `json:"leaseId"`
+	buildWorkerResponse
+}
+
+var errLeaseLost = errors.New("lease lost")
+
+// newCoordinator creates a coordinator, the workers must send the secret as the bearer token.
+func newCoordinator(secret string, leaseTTL time.Duration, maxAttempts int) *Coordinator {
+	c := &Coordinator{
+		secret:      secret,
+		leaseTTL:    leaseTTL,
+		maxAttempts: maxAttempts,
+		pending:     list.New(),
+		leases:      map[string]*remoteJob{},
+		wakeup:      make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	go c.reap()
+	return c
+}
+
+// Dispatch waits for the task to be built by a remote worker.
+func (c *Coordinator) Dispatch(ctx context.Context, task *BuildTask) (*ESMBuild, error) {
+	job := &remoteJob{
+		id:   task.ID(),
+		task: task.toWorkerTask(),
+		done: make(chan *workerResult, 1),
+	}
+	task.setStage("dispatch")
+
+	c.lock.Lock()
+	c.enqueue(job)
+	c.lock.Unlock()
+
+	select {
+	case res := <-job.done:
+		if res.Error != "" {
+			return nil, errors.New(res.Error)
+		}
+		task.Deprecated = res.Deprecated
+		return res.ESM, nil
+	case <-ctx.Done():
+		c.lock.Lock()
+		if job.el != nil {
+			c.pending.Remove(job.el)
+			job.el = nil
+		}
+		// the worker will be notified by the heartbeat
+		delete(c.leases, job.leaseID)
+		c.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Lease leases a pending task to the worker, waits for a new task until timeout if no tasks are pending.
+func (c *Coordinator) Lease(ctx context.Context, workerID string, wait time.Duration) *workerLease {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		c.lock.Lock()
+		if el := c.pending.Front(); el != nil {
+			job := c.pending.Remove(el).(*remoteJob)
+			job.el = nil
+			job.attempts++
+			job.leaseID = randomID()
+			job.workerID = workerID
+			job.expiresAt = time.Now().Add(c.leaseTTL)
+			c.leases[job.leaseID] = job
+			c.lock.Unlock()
+			log.Debugf("coordinator: lease '%s' to worker '%s'", job.id, workerID)
+			return &workerLease{ID: job.leaseID, TTL: c.leaseTTL.Milliseconds(), Task: job.task}
+		}
+		wakeup := c.wakeup
+		c.lock.Unlock()
+
+		select {
+		case <-wakeup:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-c.closed:
+			return nil
+		}
+	}
+}
+
+// Heartbeat extends the lease, returns `errLeaseLost` if the lease is expired or the task is canceled.
+func (c *Coordinator) Heartbeat(leaseID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	job, ok := c.leases[leaseID]
+	if !ok {
+		return errLeaseLost
+	}
+	job.expiresAt = time.Now().Add(c.leaseTTL)
+	return nil
+}
+
+// Complete reports the build result of the lease.
+func (c *Coordinator) Complete(result *workerResult) error {
+	c.lock.Lock()
+	job, ok := c.leases[result.LeaseID]
+	if ok {
+		delete(c.leases, result.LeaseID)
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		return errLeaseLost
+	}
+	job.done <- result
+	return nil
+}
+
+// Close stops the coordinator, the waiting workers are released.
+func (c *Coordinator) Close() {
+	close(c.closed)
+}
+
+// enqueue adds the job to the pending list and wakes up the waiting workers, the caller must hold the lock.
+func (c *Coordinator) enqueue(job *remoteJob) {
+	job.el = c.pending.PushBack(job)
+	close(c.wakeup)
+	c.wakeup = make(chan struct{})
+}
+
+// reap reassigns the tasks of the expired leases.
+func (c *Coordinator) reap() {
+	ticker := time.NewTicker(c.leaseTTL / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			for leaseID, job := range c.leases {
+				if now.After(job.expiresAt) {
+					delete(c.leases, leaseID)
+					if job.attempts >= c.maxAttempts {
+						log.Errorf("coordinator: build '%s' failed after %d attempts", job.id, job.attempts)
+						job.done <- &workerResult{buildWorkerResponse: buildWorkerResponse{
+							Error: fmt.Sprintf("build '%s': worker lost", job.id),
+						}}
+					} else {
+						log.Warnf("coordinator: worker '%s' lost, reassign '%s'", job.workerID, job.id)
+						c.enqueue(job)
+					}
+				}
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the worker api can't be used by anonymous users even if the global auth is disabled
+	if c.secret == "" || r.Header.Get("Authorization") != "Bearer "+c.secret {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var ret interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/_worker/") {
+	case "lease":
+		var req workerLeaseRequest
+		if json.NewDecoder(r.Body).Decode(&req) != nil || req.WorkerID == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		wait := time.Duration(req.Wait) * time.Millisecond
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		lease := c.Lease(r.Context(), req.WorkerID, wait)
+		if lease == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ret = lease
+	case "heartbeat":
+		var req workerHeartbeat
+		if json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if c.Heartbeat(req.LeaseID) != nil {
+			http.Error(w, errLeaseLost.Error(), http.StatusGone)
+			return
+		}
+		ret = map[string]interface{}{"ttl": c.leaseTTL.Milliseconds()}
+	case "complete":
+		var req workerResult
+		if json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if c.Complete(&req) != nil {
+			http.Error(w, errLeaseLost.Error(), http.StatusGone)
+			return
+		}
+		ret = map[string]interface{}{"ok": true}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// workerHandler serves the requests of the remote workers if the coordinator is enabled.
+func workerHandler() rex.Handle {
+	return func(ctx *rex.Context) interface{} {
+		if coordinator != nil && strings.HasPrefix(ctx.R.URL.Path, "/_worker/") {
+			return coordinator
+		}
+		return nil
+	}
+}
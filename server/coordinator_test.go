@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBuildTask(name string) *BuildTask {
+	return &BuildTask{
+		Args: BuildArgs{
+			alias:       map[string]string{},
+			deps:        PkgSlice{},
+			external:    newStringSet(),
+			treeShaking: newStringSet(),
+			conditions:  newStringSet(),
+		},
+		Pkg:          Pkg{Name: name, Version: "1.0.0"},
+		Target:       "es2022",
+		BuildVersion: VERSION,
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	c := newCoordinator("secret", 300*time.Millisecond, 2)
+	defer c.Close()
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	var builds int32
+	w := &remoteWorker{
+		id:          "test",
+		coordinator: server.URL,
+		client:      server.Client(),
+		secret:      "secret",
+		build: func(ctx context.Context, task *BuildTask) (*ESMBuild, error) {
+			atomic.AddInt32(&builds, 1)
+			// longer than the lease ttl, the lease is kept by the heartbeat
+			time.Sleep(500 * time.Millisecond)
+			return &ESMBuild{Dts: task.Pkg.Name + ".d.ts"}, nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, 2)
+
+	esm, err := c.Dispatch(context.Background(), newTestBuildTask("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esm.Dts != "foo.d.ts" {
+		t.Fatalf("unexpected build result: %v", esm)
+	}
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Fatalf("the task should be built once, but %d", n)
+	}
+}
+
+func TestCoordinatorReassign(t *testing.T) {
+	c := newCoordinator("secret", 200*time.Millisecond, 2)
+	defer c.Close()
+
+	go func() {
+		// the first worker is lost after leasing the task
+		c.Lease(context.Background(), "lost", time.Second)
+		lease := c.Lease(context.Background(), "test", time.Second)
+		if lease == nil {
+			return
+		}
+		c.Complete(&workerResult{LeaseID: lease.ID, buildWorkerResponse: buildWorkerResponse{ESM: &ESMBuild{}}})
+	}()
+	_, err := c.Dispatch(context.Background(), newTestBuildTask("foo"))
+	if err != nil {
+		t.Fatal("the task should be reassigned to another worker, but", err)
+	}
+
+	go func() {
+		c.Lease(context.Background(), "lost", time.Second)
+		c.Lease(context.Background(), "lost", time.Second)
+	}()
+	_, err = c.Dispatch(context.Background(), newTestBuildTask("bar"))
+	if err == nil {
+		t.Fatal("the task should fail after the max attempts")
+	}
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	c := newCoordinator("secret", time.Second, 2)
+	defer c.Close()
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	leased := make(chan *workerLease, 1)
+	go func() {
+		leased <- c.Lease(context.Background(), "test", time.Second)
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err := c.Dispatch(ctx, newTestBuildTask("foo"))
+	if err != context.Canceled {
+		t.Fatal("the dispatch should be canceled, but", err)
+	}
+
+	lease := <-leased
+	if lease == nil {
+		t.Fatal("the task should be leased")
+	}
+	w := &remoteWorker{coordinator: server.URL, client: server.Client(), secret: "secret"}
+	err = w.call(context.Background(), "heartbeat", workerHeartbeat{LeaseID: lease.ID}, nil)
+	if err != errLeaseLost {
+		t.Fatal("the heartbeat of the canceled task should be rejected, but", err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/_worker/lease", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	// the anonymous workers are rejected
+	w = &remoteWorker{coordinator: server.URL, client: server.Client()}
+	err = w.call(context.Background(), "heartbeat", workerHeartbeat{LeaseID: lease.ID}, nil)
+	if err == nil || err == errLeaseLost {
+		t.Fatal("the anonymous heartbeat should be rejected, but", err)
+	}
+}
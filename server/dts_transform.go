@@ -294,7 +294,7 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 		}
 	}
 
-	_, err = fs.WriteFile(savePath, buf)
+	err = task.writeArtifact(savePath, buf)
 	if err != nil {
 		return
 	}
@@ -367,6 +367,7 @@ func (task *BuildTask) toTypesPath(wd string, p NpmPackage, version string, buil
 			Target: task.Target,
 			Dev:    false,
 			wd:     wd,
+			ctx:    task.ctx,
 		}
 		_, p, _, e := t.analyze(false)
 		if e == nil {
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ImportMapInput is the input of the `POST /importmap` API.
+type ImportMapInput struct {
+	// the package specs with version ranges, e.g. "react@18", "react-dom@^18.2.0/client"
+	Packages []string `json:"packages"`
+	// the build target, default is "es2022"
+	Target string `json:"target"`
+	// the dependencies like the `?deps` query, e.g. "react@18.2.0"
+	Deps []string `json:"deps"`
+	Dev  bool     `json:"dev"`
+	// add the `integrity` entries of the modules
+	Integrity bool `json:"integrity"`
+}
+
+// ImportMap is the output of the `POST /importmap` API, see https://github.com/WICG/import-maps
+type ImportMap struct {
+	Imports   map[string]string            `json:"imports"`
+	Scopes    map[string]map[string]string `json:"scopes,omitempty"`
+	Integrity map[string]string            `json:"integrity,omitempty"`
+}
+
+const (
+	// the max number of the packages of an import map
+	importMapMaxPackages = 50
+	// the time to wait for the builds of an import map
+	importMapBuildTimeout = time.Minute
+)
+
+var errImportMapTimeout = errors.New("timeout, the packages are building in background, please try again later")
+
+// importMapEntry maps the specifier to the build of the task, in the scope of the importer
+// if the scope is not empty.
+type importMapEntry struct {
+	specifier string
+	scope     string
+	task      *BuildTask
+}
+
+// importMapGenerator generates the import map of a set of packages, the top-level packages are
+// external to each other so that every package is loaded once. If a package depends on a version
+// of another top-level package that doesn't satisfy the top-level version, the version is mapped
+// in the scope of the package.
+type importMapGenerator struct {
+	cdnOrigin string
+	target    string
+	dev       bool
+	deps      PkgSlice
+	pkgs      []Pkg
+}
+
+func newImportMapGenerator(input ImportMapInput, cdnOrigin string) (*importMapGenerator, error) {
+	if len(input.Packages) == 0 {
+		return nil, errors.New("packages is required")
+	}
+	if len(input.Packages) > importMapMaxPackages {
+		return nil, fmt.Errorf("too many packages, the max is %d", importMapMaxPackages)
+	}
+	target := input.Target
+	if target == "" {
+		target = "es2022"
+	}
+	if _, ok := targets[target]; !ok {
+		return nil, fmt.Errorf("invalid target '%s'", target)
+	}
+	return &importMapGenerator{
+		cdnOrigin: cdnOrigin,
+		target:    target,
+		dev:       input.Dev,
+	}, nil
+}
+
+// resolve resolves the package specs and the deps to the exact versions.
+func (g *importMapGenerator) resolve(input ImportMapInput) error {
+	for _, spec := range input.Deps {
+		m, _, err := validatePkgPath("/" + strings.TrimPrefix(spec, "/"))
+		if err != nil {
+			return fmt.Errorf("invalid dep '%s': %v", spec, err)
+		}
+		if !g.deps.Has(m.Name) {
+			g.deps = append(g.deps, m)
+		}
+	}
+	for _, spec := range input.Packages {
+		pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(spec, "/"))
+		if err != nil {
+			return fmt.Errorf("invalid package '%s': %v", spec, err)
+		}
+		if m, ok := g.deps.Get(pkg.Name); ok {
+			pkg.Version = m.Version
+		}
+		if strings.HasPrefix(g.target, "es") && includes(nativeNodePackages, pkg.Name) {
+			return fmt.Errorf("unsupported npm package \"%s\": native node module is not supported in browser", pkg.Name)
+		}
+		for _, p := range g.pkgs {
+			if p.Name == pkg.Name && p.Version != pkg.Version {
+				return fmt.Errorf("conflicting versions of '%s': %s and %s", pkg.Name, p.Version, pkg.Version)
+			}
+		}
+		g.pkgs = append(g.pkgs, pkg)
+	}
+	return nil
+}
+
+// entries returns the import map entries of the top-level packages and the scoped entries of
+// the conflicting versions.
+func (g *importMapGenerator) entries() []importMapEntry {
+	entries := []importMapEntry{}
+	versions := map[string]string{}
+	for _, pkg := range g.pkgs {
+		versions[pkg.Name] = pkg.Version
+		entries = append(entries, importMapEntry{specifier: pkg.ImportPath(), task: g.newTask(pkg)})
+	}
+
+	checked := map[string]bool{}
+	for _, pkg := range g.pkgs {
+		if checked[pkg.Name] || pkg.FromGithub || pkg.FromEsmsh {
+			continue
+		}
+		checked[pkg.Name] = true
+		info, _, err := getPackageInfo("", pkg.Name, pkg.Version)
+		if err != nil {
+			log.Warnf("importmap: get package info of '%s': %v", pkg.VersionName(), err)
+			continue
+		}
+		scope := g.scopeOf(g.newTask(Pkg{Name: pkg.Name, Version: pkg.Version}))
+		for _, name := range sortedKeys(versions) {
+			if name == pkg.Name || g.deps.Has(name) {
+				continue
+			}
+			versionRange, ok := info.Dependencies[name]
+			if !ok {
+				versionRange, ok = info.PeerDependencies[name]
+			}
+			if !ok || versionSatisfies(versions[name], versionRange) {
+				continue
+			}
+			dep, _, err := validatePkgPath(fmt.Sprintf("/%s@%s", name, versionRange))
+			if err != nil {
+				log.Warnf("importmap: resolve '%s@%s' for '%s': %v", name, versionRange, pkg.VersionName(), err)
+				continue
+			}
+			entries = append(entries, importMapEntry{specifier: name, scope: scope, task: g.newTask(dep)})
+		}
+	}
+	return entries
+}
+
+// newTask creates the build task of the package, the other top-level packages are external.
+func (g *importMapGenerator) newTask(pkg Pkg) *BuildTask {
+	args := newBuildArgs(pkg, g.deps)
+	for _, p := range g.pkgs {
+		if p.Name != pkg.Name {
+			args.external.Add(p.Name)
+		}
+	}
+	args = fixStableBuildArgs(args, pkg)
+	return &BuildTask{
+		Args:         args,
+		CdnOrigin:    g.cdnOrigin,
+		BuildVersion: VERSION,
+		Pkg:          pkg,
+		Target:       g.target,
+		Dev:          g.dev,
+	}
+}
+
+// scopeOf returns the scope URL of the package modules, e.g. "https://esm.sh/v127/react-dom@18.2.0/".
+func (g *importMapGenerator) scopeOf(task *BuildTask) string {
+	return fmt.Sprintf(
+		"%s%s/%s%s/%s@%s/",
+		g.cdnOrigin,
+		cfg.BasePath,
+		task.getBuildVersion(task.Pkg),
+		task.ghPrefix(),
+		task.Pkg.Name,
+		task.Pkg.Version,
+	)
+}
+
+// submodulesUrl returns the URL with trailing slash that maps the submodules of the package,
+// e.g. "https://esm.sh/v127/react@18.2.0&target=es2022/", the build version prefix is same as
+// the build ids.
+func (g *importMapGenerator) submodulesUrl(task *BuildTask) string {
+	query := "&target=" + task.Target
+	if task.Args.external.Len() > 0 {
+		external := task.Args.external.Values()
+		sort.Strings(external)
+		query += "&external=" + strings.Join(external, ",")
+	}
+	if len(task.Args.deps) > 0 {
+		deps := make([]string, len(task.Args.deps))
+		for i, m := range task.Args.deps {
+			deps[i] = m.VersionName()
+		}
+		sort.Strings(deps)
+		query += "&deps=" + strings.Join(deps, ",")
+	}
+	if task.Dev {
+		query += "&dev"
+	}
+	return fmt.Sprintf(
+		"%s%s/%s%s/%s@%s%s/",
+		g.cdnOrigin,
+		cfg.BasePath,
+		task.getBuildVersion(task.Pkg),
+		task.ghPrefix(),
+		task.Pkg.Name,
+		task.Pkg.Version,
+		query,
+	)
+}
+
+// build builds or looks up the builds of the entries, it waits for the pending builds until timeout.
+func (g *importMapGenerator) build(entries []importMapEntry, clientIp string) (map[string]*ESMBuild, error) {
+	builds := map[string]*ESMBuild{}
+	pending := map[string]*BuildQueueConsumer{}
+	tasks := map[string]*BuildTask{}
+	for _, entry := range entries {
+		id := entry.task.ID()
+		if _, ok := builds[id]; ok {
+			continue
+		}
+		if _, ok := pending[id]; ok {
+			continue
+		}
+		if esm, ok := queryESMBuild(id); ok {
+			builds[id] = esm
+			continue
+		}
+		pending[id] = buildQueue.Add(entry.task, clientIp)
+		tasks[id] = entry.task
+	}
+
+	timeout := time.After(importMapBuildTimeout)
+	for id, c := range pending {
+		select {
+		case output := <-c.C:
+			if output.err != nil {
+				g.detach(pending, tasks, builds)
+				if output.err == errTooManyBuilds {
+					return nil, output.err
+				}
+				return nil, fmt.Errorf("failed to build '%s': %v", tasks[id].Pkg, output.err)
+			}
+			builds[id] = output.meta
+		case <-timeout:
+			g.detach(pending, tasks, builds)
+			return nil, errImportMapTimeout
+		}
+	}
+	return builds, nil
+}
+
+// detach detaches the unfinished builds, they are kept building in background at a lower priority,
+// so the retry of the import map doesn't start from zero.
+func (g *importMapGenerator) detach(pending map[string]*BuildQueueConsumer, tasks map[string]*BuildTask, builds map[string]*ESMBuild) {
+	for id, c := range pending {
+		if _, ok := builds[id]; !ok {
+			buildQueue.Detach(tasks[id], c, PriorityBackground)
+		}
+	}
+}
+
+// generate generates the import map of the entries by the builds.
+func (g *importMapGenerator) generate(entries []importMapEntry, builds map[string]*ESMBuild, withIntegrity bool) (*ImportMap, error) {
+	im := &ImportMap{
+		Imports: map[string]string{},
+		Scopes:  map[string]map[string]string{},
+	}
+	if withIntegrity {
+		im.Integrity = map[string]string{}
+	}
+	for _, entry := range entries {
+		id := entry.task.ID()
+		esm, ok := builds[id]
+		if !ok || esm.TypesOnly {
+			continue
+		}
+		imports := im.Imports
+		if entry.scope != "" {
+			imports, ok = im.Scopes[entry.scope]
+			if !ok {
+				imports = map[string]string{}
+				im.Scopes[entry.scope] = imports
+			}
+		}
+		url := fmt.Sprintf("%s%s/%s", g.cdnOrigin, cfg.BasePath, id)
+		imports[entry.specifier] = url
+		name := entry.task.Pkg.Name
+		if _, ok := imports[name+"/"]; !ok {
+			imports[name+"/"] = g.submodulesUrl(g.newTask(Pkg{
+				Name:       name,
+				Version:    entry.task.Pkg.Version,
+				FromGithub: entry.task.Pkg.FromGithub,
+			}))
+		}
+		if withIntegrity {
+			integrity, err := getBuildIntegrity(id, esm)
+			if err != nil {
+				return nil, err
+			}
+			im.Integrity[url] = integrity
+			graph, _ := getPreloadGraph(id, esm)
+			for _, dep := range graph {
+				if !strings.HasPrefix(dep, "/") {
+					continue
+				}
+				integrity, err := getBuildIntegrity(strings.TrimPrefix(strings.TrimPrefix(dep, cfg.BasePath), "/"), nil)
+				if err == nil {
+					im.Integrity[g.cdnOrigin+dep] = integrity
+				}
+			}
+		}
+	}
+	if len(im.Scopes) == 0 {
+		im.Scopes = nil
+	}
+	return im, nil
+}
+
+// versionSatisfies checks if the version satisfies the version range, the ranges that are not
+// semver(e.g. dist tags or urls) are always satisfied.
+func versionSatisfies(version string, versionRange string) bool {
+	c, err := semver.NewConstraint(versionRange)
+	if err != nil {
+		return true
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return true
+	}
+	return c.Check(v)
+}
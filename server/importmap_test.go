@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestImportMapInput(t *testing.T) {
+	for _, input := range []ImportMapInput{
+		{},
+		{Packages: make([]string, importMapMaxPackages+1)},
+		{Packages: []string{"react@18"}, Target: "es3"},
+	} {
+		if _, err := newImportMapGenerator(input, "https://esm.sh"); err == nil {
+			t.Fatalf("the input %v should be rejected", input)
+		}
+	}
+}
+
+func TestVersionSatisfies(t *testing.T) {
+	for _, c := range []struct {
+		version      string
+		versionRange string
+		ok           bool
+	}{
+		{"18.2.0", "^18.0.0", true},
+		{"18.2.0", ">=16.8 <19", true},
+		{"18.2.0", "^17.0.2", false},
+		{"18.2.0", "latest", true},
+		{"18.2.0", "npm:preact@10", true},
+	} {
+		if versionSatisfies(c.version, c.versionRange) != c.ok {
+			t.Fatalf("versionSatisfies(%s, %s) should be %v", c.version, c.versionRange, c.ok)
+		}
+	}
+}
+
+func TestImportMapGenerate(t *testing.T) {
+	var err error
+	defer func(c *config.Config, d storage.DataBase, f storage.FileSystem) {
+		cfg, db, fs = c, d, f
+	}(cfg, db, fs)
+	cfg = &config.Config{}
+	dir := t.TempDir()
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newImportMapGenerator(ImportMapInput{Packages: []string{"foo@1", "bar@2/baz"}}, "https://esm.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.pkgs = []Pkg{
+		{Name: "foo", Version: "1.0.0"},
+		{Name: "bar", Version: "2.0.0", Subpath: "baz", Submodule: "baz"},
+	}
+	foo := g.newTask(g.pkgs[0])
+	baz := g.newTask(g.pkgs[1])
+	if !foo.Args.external.Has("bar") || !baz.Args.external.Has("foo") {
+		t.Fatal("the top-level packages should be external to each other")
+	}
+	// `bar@2` depends on `foo@0.9`
+	oldFoo := g.newTask(Pkg{Name: "foo", Version: "0.9.0"})
+	entries := []importMapEntry{
+		{specifier: "foo", task: foo},
+		{specifier: "bar/baz", task: baz},
+		{specifier: "foo", scope: g.scopeOf(g.newTask(Pkg{Name: "bar", Version: "2.0.0"})), task: oldFoo},
+	}
+
+	dep := fmt.Sprintf("/v%d/qux@1.0.0/es2022/qux.mjs", VERSION)
+	for _, task := range []*BuildTask{foo, baz, oldFoo} {
+		db.Put(task.ID(), []byte(fmt.Sprintf(`{"p":["%s"]}`, dep)))
+		fs.WriteFile(task.getSavepath(), strings.NewReader("export default 1"))
+	}
+	db.Put(strings.TrimPrefix(dep, "/"), []byte(`{}`))
+	fs.WriteFile("builds"+dep, strings.NewReader("export default 2"))
+
+	builds, err := g.build(entries, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := g.generate(entries, builds, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fooUrl := "https://esm.sh/" + foo.ID()
+	if im.Imports["foo"] != fooUrl || im.Imports["bar/baz"] != "https://esm.sh/"+baz.ID() {
+		t.Fatalf("invalid imports %v", im.Imports)
+	}
+	if im.Imports["foo/"] != fmt.Sprintf("https://esm.sh/v%d/foo@1.0.0&target=es2022&external=bar/", VERSION) {
+		t.Fatalf("invalid submodules url %s", im.Imports["foo/"])
+	}
+	if u := g.submodulesUrl(g.newTask(Pkg{Name: "esm-dev/qux", Version: "1.0.0", FromGithub: true})); u != fmt.Sprintf("https://esm.sh/v%d/gh/esm-dev/qux@1.0.0&target=es2022&external=bar,foo/", VERSION) {
+		t.Fatalf("invalid submodules url %s", u)
+	}
+	if u := g.submodulesUrl(g.newTask(Pkg{Name: "react", Version: "18.2.0"})); u != "https://esm.sh/stable/react@18.2.0&target=es2022/" {
+		t.Fatalf("invalid submodules url %s", u)
+	}
+	scope := fmt.Sprintf("https://esm.sh/v%d/bar@2.0.0/", VERSION)
+	if im.Scopes[scope]["foo"] != "https://esm.sh/"+oldFoo.ID() {
+		t.Fatalf("invalid scopes %v", im.Scopes)
+	}
+	if !strings.HasPrefix(im.Integrity[fooUrl], "sha384-") || im.Integrity["https://esm.sh"+dep] == "" {
+		t.Fatalf("invalid integrity %v", im.Integrity)
+	}
+}
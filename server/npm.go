@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -306,7 +307,7 @@ func fetchPackageInfo(name string, version string) (info NpmPackage, err error)
 	return
 }
 
-func installPackage(wd string, pkg Pkg) (err error) {
+func installPackage(ctx context.Context, wd string, pkg Pkg) (err error) {
 	pkgVersionName := pkg.VersionName()
 	lock := getInstallLock(pkgVersionName)
 	lock.Lock()
@@ -334,7 +335,7 @@ func installPackage(wd string, pkg Pkg) (err error) {
 
 	for i := 0; i < 3; i++ {
 		if pkg.FromEsmsh {
-			err = pnpmInstall(wd)
+			err = pnpmInstall(ctx, wd)
 			if err == nil {
 				installDir := path.Join(wd, "node_modules", pkg.Name)
 				for _, name := range []string{"package.json", "index.mjs", "index.d.ts"} {
@@ -345,15 +346,15 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				}
 			}
 		} else if pkg.FromGithub {
-			err = pnpmInstall(wd)
+			err = pnpmInstall(ctx, wd)
 			// pnpm will ignore github package which has been installed without `package.json` file
 			if err == nil && !dirExists(path.Join(wd, "node_modules", pkg.Name)) {
 				err = ghInstall(wd, pkg.Name, pkg.Version)
 			}
 		} else if regexpFullVersion.MatchString(pkg.Version) {
-			err = pnpmInstall(wd, pkgVersionName, "--prefer-offline")
+			err = pnpmInstall(ctx, wd, pkgVersionName, "--prefer-offline")
 		} else {
-			err = pnpmInstall(wd, pkgVersionName)
+			err = pnpmInstall(ctx, wd, pkgVersionName)
 		}
 		packageFilePath := path.Join(wd, "node_modules", pkg.Name, "package.json")
 		if err == nil && !fileExists(packageFilePath) {
@@ -364,7 +365,7 @@ func installPackage(wd string, pkg Pkg) (err error) {
 				err = fmt.Errorf("pnpm install %s: package.json not found", pkg)
 			}
 		}
-		if err == nil {
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 		if i < 2 {
@@ -374,7 +375,7 @@ func installPackage(wd string, pkg Pkg) (err error) {
 	return
 }
 
-func pnpmInstall(wd string, packages ...string) (err error) {
+func pnpmInstall(ctx context.Context, wd string, packages ...string) (err error) {
 	var args []string
 	if len(packages) > 0 {
 		args = append([]string{"add"}, packages...)
@@ -387,7 +388,7 @@ func pnpmInstall(wd string, packages ...string) (err error) {
 		"--loglevel", "error",
 	)
 	start := time.Now()
-	cmd := exec.Command("pnpm", args...)
+	cmd := exec.CommandContext(ctx, "pnpm", args...)
 	cmd.Dir = wd
 	if cfg.NpmToken != "" {
 		cmd.Env = append(os.Environ(), "ESM_NPM_TOKEN="+cfg.NpmToken)
@@ -403,6 +404,9 @@ func pnpmInstall(wd string, packages ...string) (err error) {
 		)
 	}
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), string(output))
 	}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ije/gox/utils"
+)
+
+const (
+	// the max depth of the transitive dependencies that are prebuilt after a module is built
+	prebuildMaxDepth = 3
+	// the max number of the dependencies of a module that are prebuilt
+	prebuildMaxFanOut = 20
+	// the max number of the prebuilds of a root build, including the transitive dependencies
+	prebuildMaxTasks = 100
+	// the prebuild is skipped if there are too many pending background tasks
+	prebuildMaxQueued = 200
+)
+
+// prebuildBudget is the number of the prebuilds that are left for a root build, it's shared by
+// the prebuilt dependencies of the root build.
+type prebuildBudget struct {
+	left int32
+}
+
+// take takes a prebuild from the budget, returns false if the budget runs out.
+func (b *prebuildBudget) take() bool {
+	return atomic.AddInt32(&b.left, -1) >= 0
+}
+
+// prebuildDeps enqueues the builds of the dependencies of the module in background, then the first
+// browser load of the module doesn't hit a cold-build waterfall for every transitive import. The
+// dependencies of the prebuilt modules are enqueued recursively when they are built.
+func (q *BuildQueue) prebuildDeps(task *BuildTask, esm *ESMBuild) {
+	if esm == nil || len(esm.Deps) == 0 || task.depth >= prebuildMaxDepth {
+		return
+	}
+	if q.backgroundLen() >= prebuildMaxQueued {
+		return
+	}
+	budget := task.prebuildBudget
+	if budget == nil {
+		budget = &prebuildBudget{prebuildMaxTasks}
+	}
+	n := 0
+	for _, dep := range esm.Deps {
+		if n >= prebuildMaxFanOut {
+			break
+		}
+		depTask, ok := parseBuildPath(dep, task.BuildVersion)
+		if !ok {
+			continue
+		}
+		n++
+		if _, ok := queryESMBuild(depTask.ID()); ok {
+			continue
+		}
+		if !budget.take() {
+			break
+		}
+		depTask.CdnOrigin = task.CdnOrigin
+		depTask.depth = task.depth + 1
+		depTask.prebuildBudget = budget
+		q.AddWithPriority(depTask, "", PriorityPrewarm)
+	}
+}
+
+// parseBuildPath parses the build path that is recorded in `ESMBuild.Deps` to a build task, e.g.
+// "/v127/react-dom@18.2.0/es2022/client.js". The remote URLs and the paths that are not built by
+// a task (e.g. the node polyfills) are ignored.
+func parseBuildPath(buildPath string, buildVersion int) (task *BuildTask, ok bool) {
+	if !strings.HasPrefix(buildPath, "/") {
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(buildPath, cfg.BasePath), "/")
+	a := strings.Split(id, "/")
+	if len(a) < 4 {
+		return
+	}
+	if a[0] != "stable" {
+		if !strings.HasPrefix(a[0], "v") {
+			return
+		}
+		v, err := strconv.Atoi(a[0][1:])
+		if err != nil {
+			return
+		}
+		buildVersion = v
+	}
+	a = a[1:]
+
+	pkgName := a[0]
+	a = a[1:]
+	if strings.HasPrefix(pkgName, "@") {
+		pkgName += "/" + a[0]
+		a = a[1:]
+	}
+	name, version := utils.SplitByLastByte(pkgName, '@')
+	if !validatePackageName(name) || !regexpFullVersion.MatchString(version) {
+		return
+	}
+
+	args := BuildArgs{
+		external:    newStringSet(),
+		treeShaking: newStringSet(),
+		conditions:  newStringSet(),
+	}
+	if len(a) > 0 && strings.HasPrefix(a[0], "X-") {
+		var err error
+		args, err = decodeBuildArgsPrefix(a[0])
+		if err != nil {
+			return
+		}
+		a = a[1:]
+	}
+	if args.denoStdVersion == "" {
+		args.denoStdVersion = denoStdVersion
+	}
+	if len(a) < 2 {
+		return
+	}
+	target := a[0]
+	if _, ok := targets[target]; !ok {
+		return nil, false
+	}
+
+	var submodule string
+	filename := strings.Join(a[1:], "/")
+	isMjs := strings.HasSuffix(filename, ".mjs")
+	if isMjs {
+		filename = strings.TrimSuffix(filename, ".mjs")
+	} else if strings.HasSuffix(filename, ".js") {
+		filename = strings.TrimSuffix(filename, ".js")
+	} else {
+		return
+	}
+	dev := strings.HasSuffix(filename, ".development")
+	filename = strings.TrimSuffix(filename, ".development")
+	if isMjs {
+		if filename != strings.TrimSuffix(path.Base(name), ".js") {
+			return
+		}
+	} else {
+		submodule = filename
+	}
+
+	task = &BuildTask{
+		Args: args,
+		Pkg: Pkg{
+			Name:      name,
+			Version:   version,
+			Subpath:   submodule,
+			Submodule: submodule,
+		},
+		Target:       target,
+		BuildVersion: buildVersion,
+		Dev:          dev,
+	}
+	// the path must be the ID of the task
+	if task.ID() != id {
+		return nil, false
+	}
+	return task, true
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestParseBuildPath(t *testing.T) {
+	defer func(c *config.Config) {
+		cfg = c
+	}(cfg)
+	cfg = &config.Config{}
+
+	sub := newTestBuildTask("foo")
+	sub.Pkg.Subpath = "lib/bar"
+	sub.Pkg.Submodule = "lib/bar"
+	scoped := newTestBuildTask("@foo/bar")
+	scoped.Dev = true
+	withArgs := newTestBuildTask("foo")
+	withArgs.Args.external.Add("react")
+	withArgs.Args.deps = PkgSlice{{Name: "react", Version: "18.2.0"}}
+	stable := newTestBuildTask("react")
+	stable.Pkg.Version = "18.2.0"
+
+	for _, task := range []*BuildTask{newTestBuildTask("foo"), sub, scoped, withArgs, stable} {
+		p, ok := parseBuildPath("/"+task.ID(), 1)
+		if !ok {
+			t.Fatalf("the build path '%s' should be parsed", task.ID())
+		}
+		if p.ID() != task.ID() {
+			t.Fatalf("the build path '%s' is parsed to '%s'", task.ID(), p.ID())
+		}
+	}
+
+	for _, buildPath := range []string{
+		"https://deno.land/std@0.177.0/node/fs.ts",
+		fmt.Sprintf("/v%d/node_process.js", VERSION),
+		fmt.Sprintf("/v%d/foo@1.0.0/es3/foo.mjs", VERSION),
+		fmt.Sprintf("/v%d/foo@1.0.0/es2022/bar.mjs", VERSION),
+		fmt.Sprintf("/v%d/foo@1/es2022/foo.mjs", VERSION),
+		fmt.Sprintf("/v%d/foo@1.0.0/es2022/foo.css", VERSION),
+	} {
+		if _, ok := parseBuildPath(buildPath, VERSION); ok {
+			t.Fatalf("the build path '%s' should be ignored", buildPath)
+		}
+	}
+}
+
+func TestPrebuildDeps(t *testing.T) {
+	var err error
+	defer func(c *config.Config, d storage.DataBase) {
+		cfg, db = c, d
+	}(cfg, db)
+	cfg = &config.Config{}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	q.failures, err = storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built := newTestBuildTask("built")
+	err = db.Put(built.ID(), []byte(`{"o":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deps := []string{"/" + built.ID(), "https://deno.land/std@0.177.0/node/fs.ts"}
+	for i := 0; i < prebuildMaxFanOut+5; i++ {
+		deps = append(deps, "/"+newTestBuildTask(fmt.Sprintf("dep%d", i)).ID())
+	}
+
+	task := newTestBuildTask("foo")
+	q.prebuildDeps(task, &ESMBuild{Deps: deps})
+	if q.Len() != prebuildMaxFanOut-1 {
+		t.Fatalf("%d deps should be prebuilt, but got %d", prebuildMaxFanOut-1, q.Len())
+	}
+	for _, qt := range q.tasks {
+		if qt.priority != PriorityPrewarm || qt.depth != 1 {
+			t.Fatalf("the dep '%s' should be prebuilt at the prewarm priority", qt.ID())
+		}
+	}
+
+	task.depth = prebuildMaxDepth
+	q.prebuildDeps(task, &ESMBuild{Deps: []string{"/" + newTestBuildTask("deep").ID()}})
+	if _, ok := q.tasks[newTestBuildTask("deep").ID()]; ok {
+		t.Fatal("the deps should not be prebuilt beyond the max depth")
+	}
+
+	// the budget is shared by the deps of the root build
+	task.depth = 0
+	task.prebuildBudget = &prebuildBudget{1}
+	q.prebuildDeps(task, &ESMBuild{Deps: []string{"/" + newTestBuildTask("x").ID(), "/" + newTestBuildTask("y").ID()}})
+	x, ok := q.tasks[newTestBuildTask("x").ID()]
+	if !ok || x.prebuildBudget != task.prebuildBudget {
+		t.Fatal("the dep should be prebuilt with the budget of the root build")
+	}
+	if _, ok := q.tasks[newTestBuildTask("y").ID()]; ok {
+		t.Fatal("the deps should not be prebuilt beyond the budget")
+	}
+
+	// the prebuild is skipped if the background queue is long
+	for i := q.backgroundLen(); i < prebuildMaxQueued; i++ {
+		q.AddWithPriority(newTestBuildTask(fmt.Sprintf("bg%d", i)), "", PriorityBackground)
+	}
+	q.prebuildDeps(newTestBuildTask("bar"), &ESMBuild{Deps: []string{"/" + newTestBuildTask("z").ID()}})
+	if _, ok := q.tasks[newTestBuildTask("z").ID()]; ok {
+		t.Fatal("the deps should not be prebuilt if the background queue is long")
+	}
+}
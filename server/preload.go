@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+const (
+	// the max number of the modules in the preload graph of an entry
+	preloadMaxModules = 64
+	// the max number of the `Link` headers of a module response, the rest of the graph can be
+	// fetched by the `?preload-html` query
+	preloadMaxLinks = 16
+	// the complete graph never changes since the build records are immutable
+	preloadGraphTTL = 24 * time.Hour
+	// the incomplete graph is cached shortly since the deps that are not built yet are not walked
+	preloadIncompleteGraphTTL = time.Minute
+)
+
+type preloadGraph struct {
+	Deps     []string `json:"deps"`
+	Complete bool     `json:"complete"`
+}
+
+// getPreloadGraph returns the transitive deps of the build in the breadth-first order, the graph is
+// computed by walking the stored build records. The graph is incomplete if some deps are not built yet.
+func getPreloadGraph(id string, esm *ESMBuild) (graph []string, complete bool) {
+	if len(esm.Deps) == 0 {
+		return nil, true
+	}
+
+	cacheKey := "preload-graph:" + id
+	if cache != nil {
+		var g preloadGraph
+		data, err := cache.Get(cacheKey)
+		if err == nil && json.Unmarshal(data, &g) == nil {
+			return g.Deps, g.Complete
+		}
+		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
+	}
+
+	graph, complete = walkDepsGraph(esm, preloadMaxModules)
+	if cache != nil {
+		data, err := json.Marshal(preloadGraph{graph, complete})
+		if err == nil {
+			ttl := preloadGraphTTL
+			if !complete {
+				ttl = preloadIncompleteGraphTTL
+			}
+			cache.Set(cacheKey, data, ttl)
+		}
+	}
+	return
+}
+
+// walkDepsGraph walks the stored build records to collect the transitive deps of the build, the
+// remote deps and the deps that are not built yet are collected but not walked. The graph is not
+// complete if any of the walked deps is not built yet.
+func walkDepsGraph(esm *ESMBuild, limit int) (graph []string, complete bool) {
+	graph = []string{}
+	complete = true
+	seen := map[string]bool{}
+	queue := append([]string{}, esm.Deps...)
+	for len(queue) > 0 && len(graph) < limit {
+		dep := queue[0]
+		queue = queue[1:]
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		graph = append(graph, dep)
+		if !strings.HasPrefix(dep, "/") {
+			continue
+		}
+		value, err := db.Get(strings.TrimPrefix(strings.TrimPrefix(dep, cfg.BasePath), "/"))
+		if err != nil || value == nil {
+			complete = false
+			continue
+		}
+		var m ESMBuild
+		if json.Unmarshal(value, &m) == nil {
+			queue = append(queue, m.Deps...)
+		} else {
+			complete = false
+		}
+	}
+	return
+}
+
+// getPreloadUrls returns the URLs of the entry module and its preload graph.
+func getPreloadUrls(cdnOrigin string, entryId string, graph []string) []string {
+	urls := make([]string, len(graph)+1)
+	urls[0] = fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.BasePath, entryId)
+	for i, dep := range graph {
+		if strings.HasPrefix(dep, "/") {
+			// the dep path contains the base path
+			dep = cdnOrigin + dep
+		}
+		urls[i+1] = dep
+	}
+	return urls
+}
+
+// preloadHTML returns a `<link rel="modulepreload">` block of the URLs that is ready to paste into the
+// `<head>` of a page.
+func preloadHTML(urls []string) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, url := range urls {
+		fmt.Fprintf(buf, `<link rel="modulepreload" href="%s">%s`, html.EscapeString(url), EOL)
+	}
+	return buf.Bytes()
+}
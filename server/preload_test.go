@@ -0,0 +1,69 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestWalkDepsGraph(t *testing.T) {
+	var err error
+	defer func(c *config.Config, d storage.DataBase) {
+		cfg, db = c, d
+	}(cfg, db)
+	cfg = &config.Config{}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a -> b, c; b -> c, d; d -> a(circular), remote
+	records := map[string]string{
+		"v1/a@1.0.0/es2022/a.mjs": `{"p":["/v1/b@1.0.0/es2022/b.mjs","/v1/c@1.0.0/es2022/c.mjs"]}`,
+		"v1/b@1.0.0/es2022/b.mjs": `{"p":["/v1/c@1.0.0/es2022/c.mjs","/v1/d@1.0.0/es2022/d.mjs"]}`,
+		"v1/d@1.0.0/es2022/d.mjs": `{"p":["/v1/a@1.0.0/es2022/a.mjs","https://deno.land/std/node/fs.ts"]}`,
+	}
+	for id, value := range records {
+		if err = db.Put(id, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	esm := &ESMBuild{Deps: []string{"/v1/a@1.0.0/es2022/a.mjs"}}
+	graph, complete := walkDepsGraph(esm, 10)
+	expected := []string{
+		"/v1/a@1.0.0/es2022/a.mjs",
+		"/v1/b@1.0.0/es2022/b.mjs",
+		"/v1/c@1.0.0/es2022/c.mjs",
+		"/v1/d@1.0.0/es2022/d.mjs",
+		"https://deno.land/std/node/fs.ts",
+	}
+	if strings.Join(graph, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected graph %v", graph)
+	}
+	// c is not built yet
+	if complete {
+		t.Fatal("the graph should be incomplete")
+	}
+	if graph, _ = walkDepsGraph(esm, 2); len(graph) != 2 {
+		t.Fatalf("the graph should be limited, but got %v", graph)
+	}
+	if err = db.Put("v1/c@1.0.0/es2022/c.mjs", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, complete = walkDepsGraph(esm, 10); !complete {
+		t.Fatal("the graph should be complete")
+	}
+
+	urls := getPreloadUrls("https://esm.sh", "v1/foo@1.0.0/es2022/foo.mjs", expected[3:])
+	html := string(preloadHTML(urls))
+	if html != `<link rel="modulepreload" href="https://esm.sh/v1/foo@1.0.0/es2022/foo.mjs">`+EOL+
+		`<link rel="modulepreload" href="https://esm.sh/v1/d@1.0.0/es2022/d.mjs">`+EOL+
+		`<link rel="modulepreload" href="https://deno.land/std/node/fs.ts">`+EOL {
+		t.Fatalf("unexpected html %q", html)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrewarmInput is the input of the `POST /prewarm` API.
+type PrewarmInput struct {
+	// the package specs, e.g. "react@18", "react-dom@18/client"
+	Packages []string `json:"packages"`
+	// the build targets, default is ["es2022"]
+	Targets []string `json:"targets"`
+	// the dependencies like the `?deps` query, e.g. "react@18.2.0"
+	Deps   []string `json:"deps"`
+	Dev    bool     `json:"dev"`
+	Bundle bool     `json:"bundle"`
+}
+
+const (
+	// the max number of the packages of a prewarm job
+	prewarmMaxPackages = 1000
+	// the prewarm job is dropped after the ttl
+	prewarmJobTTL = 24 * time.Hour
+)
+
+// prewarmJob builds a set of packages at the prewarm priority ahead of the traffic.
+type prewarmJob struct {
+	lock      sync.Mutex
+	id        string
+	createdAt time.Time
+	resolving bool
+	taskIDs   []string
+	errors    []map[string]string
+}
+
+var prewarmJobs sync.Map
+
+// newPrewarmJob validates the input and starts a prewarm job, the package specs are resolved
+// in background.
+func newPrewarmJob(input PrewarmInput, cdnOrigin string) (*prewarmJob, error) {
+	if len(input.Packages) == 0 {
+		return nil, errors.New("packages is required")
+	}
+	if len(input.Packages) > prewarmMaxPackages {
+		return nil, fmt.Errorf("too many packages, the max is %d", prewarmMaxPackages)
+	}
+	if len(input.Targets) == 0 {
+		input.Targets = []string{"es2022"}
+	}
+	for _, target := range input.Targets {
+		if _, ok := targets[target]; !ok {
+			return nil, fmt.Errorf("invalid target '%s'", target)
+		}
+	}
+
+	job := &prewarmJob{
+		id:        randomID(),
+		createdAt: time.Now(),
+		resolving: true,
+	}
+	prewarmJobs.Store(job.id, job)
+	time.AfterFunc(prewarmJobTTL, func() {
+		prewarmJobs.Delete(job.id)
+	})
+	go job.run(input, cdnOrigin)
+	return job, nil
+}
+
+func (job *prewarmJob) run(input PrewarmInput, cdnOrigin string) {
+	defer func() {
+		job.lock.Lock()
+		job.resolving = false
+		job.lock.Unlock()
+	}()
+
+	deps := PkgSlice{}
+	for _, spec := range input.Deps {
+		m, _, err := validatePkgPath("/" + strings.TrimPrefix(spec, "/"))
+		if err != nil {
+			job.addError(spec, err)
+			continue
+		}
+		if !deps.Has(m.Name) {
+			deps = append(deps, m)
+		}
+	}
+
+	for _, spec := range input.Packages {
+		pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(spec, "/"))
+		if err != nil {
+			job.addError(spec, err)
+			continue
+		}
+		args := fixStableBuildArgs(newBuildArgs(pkg, deps), pkg)
+		for _, target := range input.Targets {
+			if strings.HasPrefix(target, "es") && includes(nativeNodePackages, pkg.Name) {
+				job.addError(spec, fmt.Errorf("unsupported npm package \"%s\": native node module is not supported in browser", pkg.Name))
+				continue
+			}
+			task := &BuildTask{
+				Args:         args,
+				CdnOrigin:    cdnOrigin,
+				BuildVersion: VERSION,
+				Pkg:          pkg,
+				Target:       target,
+				Dev:          input.Dev,
+				Bundle:       input.Bundle && !stableBuild[pkg.Name],
+			}
+			id := task.ID()
+			job.lock.Lock()
+			job.taskIDs = append(job.taskIDs, id)
+			job.lock.Unlock()
+			if _, ok := queryESMBuild(id); !ok {
+				buildQueue.AddWithPriority(task, "", PriorityPrewarm)
+			}
+		}
+	}
+}
+
+func (job *prewarmJob) addError(spec string, err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.errors = append(job.errors, map[string]string{"package": spec, "error": err.Error()})
+}
+
+// status returns the progress of the job: "resolving", "pending" or "done".
+func (job *prewarmJob) status() map[string]interface{} {
+	job.lock.Lock()
+	resolving := job.resolving
+	taskIDs := make([]string, len(job.taskIDs))
+	copy(taskIDs, job.taskIDs)
+	errs := make([]map[string]string, len(job.errors))
+	copy(errs, job.errors)
+	job.lock.Unlock()
+
+	tasks := make([]map[string]interface{}, len(taskIDs))
+	pending, done, failed := 0, 0, 0
+	for i, id := range taskIDs {
+		status := getBuildStatus(id)
+		if status == nil {
+			// e.g. the failure record is expired
+			status = map[string]interface{}{"id": id, "status": "unknown"}
+		}
+		switch status["status"] {
+		case "queued", "building":
+			pending++
+		case "done":
+			done++
+		case "failed":
+			failed++
+		}
+		tasks[i] = status
+	}
+
+	s := "done"
+	if resolving {
+		s = "resolving"
+	} else if pending > 0 {
+		s = "pending"
+	}
+	return map[string]interface{}{
+		"id":        job.id,
+		"status":    s,
+		"createdAt": job.createdAt.Format(http.TimeFormat),
+		"total":     len(taskIDs),
+		"pending":   pending,
+		"done":      done,
+		"failed":    failed,
+		"tasks":     tasks,
+		"errors":    errs,
+	}
+}
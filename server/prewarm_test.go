@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestPrewarmInput(t *testing.T) {
+	for _, input := range []PrewarmInput{
+		{},
+		{Packages: make([]string, prewarmMaxPackages+1)},
+		{Packages: []string{"react@18"}, Targets: []string{"es3"}},
+	} {
+		if _, err := newPrewarmJob(input, "https://esm.sh"); err == nil {
+			t.Fatalf("the input %v should be rejected", input)
+		}
+	}
+}
+
+func TestPrewarmJobStatus(t *testing.T) {
+	var err error
+	defer func(d storage.DataBase, q *BuildQueue) {
+		db, buildQueue = d, q
+	}(db, buildQueue)
+	db, err = storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// no processes, the tasks are always pending
+	buildQueue = newBuildQueue(0)
+	buildQueue.failures, err = storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo := newTestBuildTask("foo")
+	bar := newTestBuildTask("bar")
+	buildQueue.AddWithPriority(foo, "", PriorityPrewarm)
+	buildQueue.recordFailure(&queueTask{BuildTask: bar}, errors.New("oops"))
+	job := &prewarmJob{
+		id:      "test",
+		taskIDs: []string{foo.ID(), bar.ID()},
+		errors:  []map[string]string{{"package": "baz", "error": "not found"}},
+	}
+
+	status := job.status()
+	if status["status"] != "pending" || status["total"] != 2 || status["pending"] != 1 || status["failed"] != 1 {
+		t.Fatalf("unexpected status %v", status)
+	}
+	if errs := status["errors"].([]map[string]string); len(errs) != 1 || errs[0]["package"] != "baz" {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	// the task is done
+	delete(buildQueue.tasks, foo.ID())
+	// a types only build has no build file to check
+	db.Put(foo.ID(), []byte(`{"o":true}`))
+	status = job.status()
+	if status["status"] != "done" || status["done"] != 1 || status["failed"] != 1 {
+		t.Fatalf("unexpected status %v", status)
+	}
+}
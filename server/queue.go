@@ -2,9 +2,14 @@ package server
 
 import (
 	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
 )
 
 // A Queue for esm build tasks
@@ -14,8 +19,68 @@ type BuildQueue struct {
 	tasks        map[string]*queueTask
 	processes    []*queueTask
 	maxProcesses int
+	// the number of processes that the low priority tasks can't use
+	reservedProcesses int
+	// the database to persist the tasks, the tasks are not persisted if it's nil
+	store storage.DataBase
+	// serializes the writes of the persisted tasks
+	storeLock sync.Mutex
+	// the cache to record the failed tasks, the failures are not cached if it's nil
+	failures storage.Cache
+	// the max number of the processes/tasks of a client, 0 means no limit
+	clientMaxProcesses int
+	clientMaxTasks     int
+	// the number of the tasks that are added by each client
+	clientTasks map[string]int
+}
+
+// BuildPriority is the priority class of a build task, the lower value has the higher priority.
+type BuildPriority int
+
+const (
+	// a user is waiting for the build
+	PriorityInteractive BuildPriority = iota
+	// rebuilding in background while a previous build version is served
+	PriorityBackground
+	// building ahead of the requests
+	PriorityPrewarm
+)
+
+func (p BuildPriority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBackground:
+		return "background"
+	case PriorityPrewarm:
+		return "prewarm"
+	}
+	return "unknown"
 }
 
+// a pending task is promoted to the higher priority class every `priorityAgingInterval`
+// to avoid starvation of the low priority tasks, a non-interactive task is never promoted to
+// the interactive class, so it can't take the reserved processes of the users
+const priorityAgingInterval = 30 * time.Second
+
+// the db key prefix of the persisted tasks
+const queueRecordPrefix = "queue/"
+
+// the max number of the restores of a persisted task, a task that keeps crashing the server
+// is dropped after that
+const queueMaxRestores = 3
+
+// queueRecord is the persisted task that is restored after the server restarts.
+type queueRecord struct {
+	Task     *buildWorkerTask `json:"task"`
+	Priority BuildPriority    `json:"priority"`
+	// the number of the restores of the task
+	Restores int `json:"restores,omitempty"`
+}
+
+// errTooManyBuilds is returned if a client adds more tasks than the `clientMaxTasks` limit.
+var errTooManyBuilds = errors.New("too many builds from your client, please try again later")
+
 type BuildQueueConsumer struct {
 	IP string           `json:"ip"`
 	C  chan BuildOutput `json:"-"`
@@ -28,43 +93,99 @@ type BuildOutput struct {
 
 type queueTask struct {
 	*BuildTask
+	// the client(IP) that added the task, empty for the background tasks
+	client    string
+	priority  BuildPriority
 	inProcess bool
-	el        *list.Element
-	createdAt time.Time
-	startedAt time.Time
-	consumers []*BuildQueueConsumer
+	// the task is wanted even if there are no consumers, e.g. a background rebuild
+	background bool
+	cancel     context.CancelFunc
+	el         *list.Element
+	createdAt  time.Time
+	startedAt  time.Time
+	consumers  []*BuildQueueConsumer
+	// the number of the restores of the task, see `queueRecord`
+	restores int
 }
 
-func (t *queueTask) run() BuildOutput {
+// the max duration of a build task
+const buildTimeout = 10 * time.Minute
+
+func (t *queueTask) run(ctx context.Context) BuildOutput {
 	c := make(chan BuildOutput, 1)
 	go func(c chan BuildOutput) {
-		meta, err := t.Build()
+		var meta *ESMBuild
+		var err error
+		for i := 0; ; i++ {
+			meta, err = t.build(ctx)
+			if err == nil || i >= buildRetries || !isTransientError(err) || ctx.Err() != nil {
+				break
+			}
+			delay := buildRetryDelay << i
+			log.Warnf("build '%s': %v, retry in %v", t.ID(), err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
 		c <- BuildOutput{meta, err}
 	}(c)
 
 	var output BuildOutput
 	select {
 	case output = <-c:
+	case <-ctx.Done():
+		// the child processes are killed and the esbuild is canceled, no need to wait for the build
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		log.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt))
+		output = BuildOutput{
+			err: fmt.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt)),
+		}
+	case context.Canceled:
+		log.Warnf("build '%s': canceled since no consumers", t.ID())
+		output = BuildOutput{
+			err: fmt.Errorf("build '%s': canceled", t.ID()),
+		}
+	default:
 		if output.err == nil {
 			log.Infof("build '%s' done in %v", t.ID(), time.Since(t.startedAt))
 		} else {
 			log.Errorf("build '%s': %v", t.ID(), output.err)
 		}
-	case <-time.After(10 * time.Minute):
-		log.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt))
-		output = BuildOutput{
-			err: fmt.Errorf("build '%s': timeout(%v)", t.ID(), time.Since(t.startedAt)),
-		}
 	}
 
 	return output
 }
 
+func (t *queueTask) build(ctx context.Context) (*ESMBuild, error) {
+	// the "raw" task only installs the package, no need to isolate it
+	if coordinator != nil && t.Target != "raw" {
+		return coordinator.Dispatch(ctx, t.BuildTask)
+	}
+	if cfg.BuildWorker && t.Target != "raw" {
+		// the worker process takes a slot of the build stage, like the build in process
+		pool := t.stagePool()
+		err := pool.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.release()
+		return t.buildInWorker(ctx)
+	}
+	return t.safeBuild(ctx)
+}
+
 func newBuildQueue(maxProcesses int) *BuildQueue {
 	q := &BuildQueue{
 		list:         list.New(),
 		tasks:        map[string]*queueTask{},
+		clientTasks:  map[string]int{},
 		maxProcesses: maxProcesses,
+		// keep a quarter of the processes for the interactive tasks
+		reservedProcesses: maxProcesses / 4,
 	}
 	return q
 }
@@ -77,13 +198,45 @@ func (q *BuildQueue) Len() int {
 	return q.list.Len()
 }
 
-// Add adds a new build task.
+// backgroundLen returns the number of the pending background tasks.
+func (q *BuildQueue) backgroundLen() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	n := 0
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if ok && !t.inProcess && t.priority >= PriorityBackground {
+			n++
+		}
+	}
+	return n
+}
+
+// Add adds a new build task, the task is interactive if the consumerIp is not empty,
+// otherwise it's a background task.
 func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer {
+	priority := PriorityInteractive
+	if consumerIp == "" {
+		priority = PriorityBackground
+	}
+	return q.AddWithPriority(task, consumerIp, priority)
+}
+
+// AddWithPriority adds a new build task with the priority class, the existing task is
+// promoted if the new priority is higher.
+func (q *BuildQueue) AddWithPriority(task *BuildTask, consumerIp string, priority BuildPriority) *BuildQueueConsumer {
+	return q.add(task, consumerIp, priority, 0)
+}
+
+func (q *BuildQueue) add(task *BuildTask, consumerIp string, priority BuildPriority, restores int) *BuildQueueConsumer {
 	c := &BuildQueueConsumer{consumerIp, make(chan BuildOutput, 1)}
 	q.lock.Lock()
 	t, ok := q.tasks[task.ID()]
-	if ok && consumerIp != "" {
-		t.consumers = append(t.consumers, c)
+	// the limit only applies to the new tasks, joining an existing task is cheap
+	overLimit := !ok && consumerIp != "" && q.clientMaxTasks > 0 && q.clientTasks[consumerIp] >= q.clientMaxTasks
+	if ok {
+		t.join(c, priority)
 	}
 	q.lock.Unlock()
 
@@ -91,73 +244,213 @@ func (q *BuildQueue) Add(task *BuildTask, consumerIp string) *BuildQueueConsumer
 		return c
 	}
 
-	task.stage = "pending"
+	if overLimit {
+		log.Warnf("build '%s': too many builds from %s", task.ID(), consumerIp)
+		c.C <- BuildOutput{err: errTooManyBuilds}
+		return c
+	}
+
+	// the task failed recently, return the recorded error until the backoff expires
+	if f := q.loadFailure(task.ID()); f != nil && time.Now().UnixMilli() < f.RetryAt {
+		c.C <- BuildOutput{err: f}
+		return c
+	}
+
+	q.lock.Lock()
+	// the task may be added by others while the lock is released
+	if t, ok := q.tasks[task.ID()]; ok {
+		t.join(c, priority)
+		q.lock.Unlock()
+		return c
+	}
+	task.progress = newBuildProgress()
+	task.setStage("pending")
 	t = &queueTask{
-		BuildTask: task,
-		createdAt: time.Now(),
-		consumers: []*BuildQueueConsumer{},
+		BuildTask:  task,
+		client:     consumerIp,
+		priority:   priority,
+		background: consumerIp == "",
+		createdAt:  time.Now(),
+		consumers:  []*BuildQueueConsumer{},
+		restores:   restores,
 	}
 	if consumerIp != "" {
 		t.consumers = []*BuildQueueConsumer{c}
 	}
-	q.lock.Lock()
 	t.el = q.list.PushBack(t)
 	q.tasks[task.ID()] = t
+	if t.client != "" {
+		q.clientTasks[t.client]++
+	}
 	q.lock.Unlock()
 
+	// persist the task until it's done, the record is removed after that
+	q.persist(t)
+
 	q.next()
+	q.emitPositions()
 
 	return c
 }
 
+// join adds the consumer to the task, the task is promoted if the priority is higher.
+// The caller must hold the lock.
+func (t *queueTask) join(c *BuildQueueConsumer, priority BuildPriority) {
+	if c.IP != "" {
+		t.consumers = append(t.consumers, c)
+	} else {
+		t.background = true
+	}
+	if priority < t.priority {
+		t.priority = priority
+	}
+}
+
+// RemoveConsumer removes the consumer of the task, the task is canceled if nobody is waiting for it.
 func (q *BuildQueue) RemoveConsumer(task *BuildTask, c *BuildQueueConsumer) {
+	removed := false
 	q.lock.Lock()
-	defer q.lock.Unlock()
-
 	t, ok := q.tasks[task.ID()]
 	if ok {
 		consumers := make([]*BuildQueueConsumer, len(t.consumers))
 		i := 0
+		found := false
 		for _, _c := range t.consumers {
 			if _c != c {
-				consumers[i] = c
+				consumers[i] = _c
 				i++
+			} else {
+				found = true
 			}
 		}
 		t.consumers = consumers[0:i]
-	}
-}
 
-func (q *BuildQueue) next() {
-	var nextTask *queueTask
-	q.lock.Lock()
-	if len(q.processes) < q.maxProcesses {
-		for el := q.list.Front(); el != nil; el = el.Next() {
-			t, ok := el.Value.(*queueTask)
-			if ok && !t.inProcess {
-				nextTask = t
-				break
+		if found && len(t.consumers) == 0 && !t.background {
+			delete(q.tasks, t.ID())
+			if t.inProcess {
+				t.cancel()
+			} else {
+				q.list.Remove(t.el)
+				q.releaseClient(t)
 			}
+			removed = true
 		}
 	}
 	q.lock.Unlock()
 
-	if nextTask == nil {
+	if removed {
+		q.unpersist(t)
+		q.emitPositions()
+	}
+}
+
+// Detach removes the consumer of the task without canceling it, the task is kept as a background
+// task, and it's demoted to the priority if nobody else is waiting for it.
+func (q *BuildQueue) Detach(task *BuildTask, c *BuildQueueConsumer, priority BuildPriority) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	t, ok := q.tasks[task.ID()]
+	if !ok {
 		return
 	}
+	consumers := make([]*BuildQueueConsumer, 0, len(t.consumers))
+	for _, _c := range t.consumers {
+		if _c != c {
+			consumers = append(consumers, _c)
+		}
+	}
+	t.consumers = consumers
+	t.background = true
+	if len(t.consumers) == 0 && priority > t.priority {
+		t.priority = priority
+	}
+}
 
+func (q *BuildQueue) next() {
+	var ctx context.Context
 	q.lock.Lock()
-	nextTask.inProcess = true
-	q.processes = append(q.processes, nextTask)
+	nextTask := q.pick(time.Now())
+	if nextTask != nil {
+		ctx, nextTask.cancel = context.WithTimeout(context.Background(), buildTimeout)
+		nextTask.inProcess = true
+		q.processes = append(q.processes, nextTask)
+	}
 	q.lock.Unlock()
 
-	go q.wait(nextTask)
+	if nextTask != nil {
+		go q.wait(ctx, nextTask)
+	}
+}
+
+// pick picks the pending task with the highest effective priority, tasks of the same priority
+// are picked from the client that has the fewest running tasks, then in FIFO order.
+// The caller must hold the lock.
+func (q *BuildQueue) pick(now time.Time) *queueTask {
+	if len(q.processes) >= q.maxProcesses {
+		return nil
+	}
+	running := map[string]int{}
+	for _, t := range q.processes {
+		running[t.client]++
+	}
+	var nextTask *queueTask
+	var nextPriority BuildPriority
+	for el := q.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if ok && !t.inProcess {
+			// the client has too many running tasks
+			if t.client != "" && q.clientMaxProcesses > 0 && running[t.client] >= q.clientMaxProcesses {
+				continue
+			}
+			p := t.effectivePriority(now)
+			if nextTask == nil || p < nextPriority || (p == nextPriority && running[t.client] < running[nextTask.client]) {
+				nextTask = t
+				nextPriority = p
+			}
+		}
+	}
+	// the low priority tasks can't use the reserved processes
+	if nextTask != nil && nextPriority > PriorityInteractive && len(q.processes) >= q.maxProcesses-q.reservedProcesses {
+		return nil
+	}
+	return nextTask
 }
 
-func (q *BuildQueue) wait(t *queueTask) {
+// releaseClient releases the task count of the client, the caller must hold the lock.
+func (q *BuildQueue) releaseClient(t *queueTask) {
+	if t.client != "" {
+		q.clientTasks[t.client]--
+		if q.clientTasks[t.client] <= 0 {
+			delete(q.clientTasks, t.client)
+		}
+	}
+}
+
+// effectivePriority returns the priority that is promoted by the waiting time.
+func (t *queueTask) effectivePriority(now time.Time) BuildPriority {
+	if t.priority == PriorityInteractive {
+		return t.priority
+	}
+	p := t.priority - BuildPriority(now.Sub(t.createdAt)/priorityAgingInterval)
+	if p < PriorityBackground {
+		p = PriorityBackground
+	}
+	return p
+}
+
+func (q *BuildQueue) wait(ctx context.Context, t *queueTask) {
 	t.startedAt = time.Now()
 
-	output := t.run()
+	output := t.run(ctx)
+	canceled := ctx.Err() == context.Canceled
+	t.cancel()
+
+	if output.err == nil {
+		q.clearFailure(t.ID())
+	} else if !canceled {
+		q.recordFailure(t, output.err)
+	}
 
 	q.lock.Lock()
 	a := make([]*queueTask, len(q.processes))
@@ -170,13 +463,118 @@ func (q *BuildQueue) wait(t *queueTask) {
 	}
 	q.processes = a[0:i]
 	q.list.Remove(t.el)
-	delete(q.tasks, t.ID())
+	q.releaseClient(t)
+	// the canceled task may be replaced by a new task with the same ID
+	replaced := q.tasks[t.ID()] != t
+	if !replaced {
+		delete(q.tasks, t.ID())
+	}
 	q.lock.Unlock()
 
+	if !replaced {
+		q.unpersist(t)
+	}
+
 	// call next task
 	q.next()
+	q.emitPositions()
+
+	if output.err != nil {
+		t.emit(BuildEvent{Type: "error", Stage: t.stage, Error: output.err.Error()})
+	} else {
+		t.emit(BuildEvent{Type: "done", ESM: output.meta})
+		go q.prebuildDeps(t.BuildTask, output.meta)
+	}
 
 	for _, c := range t.consumers {
 		c.C <- output
 	}
 }
+
+// Restore restores the tasks that are persisted in the store, then persists the new tasks to it.
+// The restored tasks have no consumers, they are built in background.
+func (q *BuildQueue) Restore(store storage.DataBase) (n int, err error) {
+	q.lock.Lock()
+	q.store = store
+	q.lock.Unlock()
+
+	var records []queueRecord
+	var keys []string
+	var badKeys []string
+	err = store.Scan(queueRecordPrefix, func(key string, value []byte) error {
+		var r queueRecord
+		if json.Unmarshal(value, &r) != nil || r.Task == nil {
+			badKeys = append(badKeys, key)
+		} else {
+			records = append(records, r)
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, key := range badKeys {
+		store.Delete(key)
+	}
+
+	for i, r := range records {
+		if r.Restores >= queueMaxRestores {
+			log.Warnf("drop the build task '%s' that has been restored %d times", keys[i], r.Restores)
+			store.Delete(keys[i])
+			continue
+		}
+		task := r.Task.toBuildTask()
+		// the duplicate tasks are merged by the ID
+		q.add(task, "", r.Priority, r.Restores+1)
+		n++
+	}
+	return
+}
+
+// persist stores the task in the store, the record is removed after the task is done.
+// The task is not stored if it's done or replaced already.
+func (q *BuildQueue) persist(t *queueTask) {
+	q.storeLock.Lock()
+	defer q.storeLock.Unlock()
+
+	q.lock.RLock()
+	store := q.store
+	current := q.tasks[t.ID()] == t
+	q.lock.RUnlock()
+	if store == nil || !current {
+		return
+	}
+
+	data, err := json.Marshal(queueRecord{
+		Task:     t.toWorkerTask(),
+		Priority: t.priority,
+		Restores: t.restores,
+	})
+	if err == nil {
+		err = store.Put(queueRecordPrefix+t.ID(), data)
+	}
+	if err != nil {
+		log.Warnf("persist build task '%s': %v", t.ID(), err)
+	}
+}
+
+// unpersist removes the record of the task, the record is kept if the task is replaced by a
+// new task with the same ID.
+func (q *BuildQueue) unpersist(t *queueTask) {
+	q.storeLock.Lock()
+	defer q.storeLock.Unlock()
+
+	q.lock.RLock()
+	store := q.store
+	replaced := q.tasks[t.ID()] != nil && q.tasks[t.ID()] != t
+	q.lock.RUnlock()
+	if store == nil || replaced {
+		return
+	}
+
+	err := store.Delete(queueRecordPrefix + t.ID())
+	if err != nil {
+		log.Warnf("remove persisted build task '%s': %v", t.ID(), err)
+	}
+}
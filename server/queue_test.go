@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestBuildQueuePriority(t *testing.T) {
+	q := newBuildQueue(4)
+	now := time.Now()
+	push := func(id string, priority BuildPriority, createdAt time.Time) *queueTask {
+		t := &queueTask{
+			BuildTask: &BuildTask{id: id},
+			priority:  priority,
+			createdAt: createdAt,
+		}
+		t.el = q.list.PushBack(t)
+		q.tasks[id] = t
+		return t
+	}
+	run := func(t *queueTask) {
+		t.inProcess = true
+		q.processes = append(q.processes, t)
+	}
+
+	push("prewarm", PriorityPrewarm, now.Add(-time.Second))
+	push("background", PriorityBackground, now.Add(-time.Second))
+	push("interactive", PriorityInteractive, now)
+
+	if task := q.pick(now); task == nil || task.ID() != "interactive" {
+		t.Fatal("the interactive task should be picked first")
+	}
+	run(q.tasks["interactive"])
+	if task := q.pick(now); task == nil || task.ID() != "background" {
+		t.Fatal("the background task should be picked before the prewarm task")
+	}
+	run(q.tasks["background"])
+	if task := q.pick(now); task == nil || task.ID() != "prewarm" {
+		t.Fatal("the prewarm task should be picked")
+	}
+	run(q.tasks["prewarm"])
+
+	// the last process is reserved for the interactive tasks
+	push("background2", PriorityBackground, now)
+	if task := q.pick(now); task != nil {
+		t.Fatalf("the background task should not use the reserved process, but picked '%s'", task.ID())
+	}
+
+	// the background task is never promoted to the interactive class
+	if task := q.pick(now.Add(10 * priorityAgingInterval)); task != nil {
+		t.Fatalf("the aged background task should not use the reserved process, but picked '%s'", task.ID())
+	}
+
+	// the prewarm task is promoted to the background class after waiting for a while
+	prewarm := &queueTask{BuildTask: &BuildTask{id: "prewarm2"}, priority: PriorityPrewarm, createdAt: now}
+	if p := prewarm.effectivePriority(now.Add(priorityAgingInterval)); p != PriorityBackground {
+		t.Fatalf("the starving prewarm task should be promoted to background, but %s", p)
+	}
+	if p := prewarm.effectivePriority(now.Add(10 * priorityAgingInterval)); p != PriorityBackground {
+		t.Fatalf("the prewarm task should not be promoted beyond background, but %s", p)
+	}
+
+	push("interactive2", PriorityInteractive, now)
+	if task := q.pick(now.Add(10 * priorityAgingInterval)); task == nil || task.ID() != "interactive2" {
+		t.Fatal("the interactive task should use the reserved process before the aged background task")
+	}
+	run(q.tasks["interactive2"])
+	if task := q.pick(now); task != nil {
+		t.Fatal("the queue is full")
+	}
+}
+
+func TestBuildQueueRemoveConsumer(t *testing.T) {
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+
+	task := &BuildTask{id: "foo"}
+	c1 := q.Add(task, "127.0.0.1")
+	c2 := q.Add(task, "127.0.0.2")
+	q.RemoveConsumer(task, c1)
+	if q.Len() != 1 || len(q.tasks["foo"].consumers) != 1 || q.tasks["foo"].consumers[0] != c2 {
+		t.Fatal("only the removed consumer should be detached")
+	}
+	q.RemoveConsumer(task, c2)
+	if q.Len() != 0 || q.tasks["foo"] != nil {
+		t.Fatal("the task should be removed since no consumers")
+	}
+
+	// the background task is kept
+	bgTask := &BuildTask{id: "bar"}
+	q.Add(bgTask, "")
+	c := q.Add(bgTask, "127.0.0.1")
+	q.RemoveConsumer(bgTask, c)
+	if q.Len() != 1 {
+		t.Fatal("the background task should be kept")
+	}
+
+	// the running task is canceled
+	task = &BuildTask{id: "baz"}
+	c = q.Add(task, "127.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	q.tasks["baz"].inProcess = true
+	q.tasks["baz"].cancel = cancel
+	q.RemoveConsumer(task, c)
+	if ctx.Err() != context.Canceled {
+		t.Fatal("the running task should be canceled")
+	}
+	if q.tasks["baz"] != nil {
+		t.Fatal("the canceled task should be detached")
+	}
+}
+
+func TestBuildQueueDetach(t *testing.T) {
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+
+	task := &BuildTask{id: "foo"}
+	c1 := q.Add(task, "127.0.0.1")
+	c2 := q.Add(task, "127.0.0.2")
+	q.Detach(task, c1, PriorityBackground)
+	if q.tasks["foo"].priority != PriorityInteractive {
+		t.Fatal("the task should not be demoted while others are waiting for it")
+	}
+	q.Detach(task, c2, PriorityBackground)
+	if q.Len() != 1 || len(q.tasks["foo"].consumers) != 0 || q.tasks["foo"].priority != PriorityBackground {
+		t.Fatal("the detached task should be kept in background")
+	}
+	q.RemoveConsumer(task, c2)
+	if q.Len() != 1 {
+		t.Fatal("the detached task should not be canceled")
+	}
+}
+
+func TestBuildQueueRestore(t *testing.T) {
+	store, err := storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	_, err = q.Restore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := newTestBuildTask("foo")
+	bar := newTestBuildTask("bar")
+	q.AddWithPriority(foo, "", PriorityPrewarm)
+	q.AddWithPriority(newTestBuildTask("foo"), "", PriorityPrewarm)
+	c := q.Add(bar, "127.0.0.1")
+	q.Add(newTestBuildTask("baz"), "127.0.0.1")
+
+	// the task without consumers is removed from the store
+	q.RemoveConsumer(bar, c)
+	value, err := store.Get(queueRecordPrefix + bar.ID())
+	if err != nil || value != nil {
+		t.Fatal("the removed task should not be persisted")
+	}
+
+	// restart
+	q2 := newBuildQueue(0)
+	n, err := q2.Restore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || q2.Len() != 2 {
+		t.Fatalf("expected 2 restored tasks, but got %d", n)
+	}
+	task := q2.tasks[foo.ID()]
+	if task == nil || task.priority != PriorityPrewarm || !task.background {
+		t.Fatal("the task should be restored as a background task with the priority")
+	}
+	if q2.tasks[newTestBuildTask("baz").ID()] == nil {
+		t.Fatal("the interactive task should be restored")
+	}
+
+	// the task that keeps crashing the server is dropped
+	for i := 1; i < queueMaxRestores; i++ {
+		q3 := newBuildQueue(0)
+		if n, _ = q3.Restore(store); n != 2 {
+			t.Fatalf("expected 2 restored tasks, but got %d", n)
+		}
+	}
+	if n, _ = newBuildQueue(0).Restore(store); n != 0 {
+		t.Fatalf("the tasks should be dropped after %d restores, but got %d", queueMaxRestores, n)
+	}
+	value, err = store.Get(queueRecordPrefix + foo.ID())
+	if err != nil || value != nil {
+		t.Fatal("the dropped task should be removed from the store")
+	}
+}
+
+func TestBuildQueueUnpersistReplaced(t *testing.T) {
+	store, err := storage.OpenDB("bolt:" + filepath.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	q := newBuildQueue(0)
+	q.Restore(store)
+	task := newTestBuildTask("foo")
+	c := q.Add(task, "127.0.0.1")
+	old := q.tasks[task.ID()]
+
+	// the old task is removed and replaced by a new one before its record is removed
+	q.lock.Lock()
+	delete(q.tasks, task.ID())
+	q.list.Remove(old.el)
+	q.lock.Unlock()
+	q.Add(newTestBuildTask("foo"), "127.0.0.1")
+	q.unpersist(old)
+	q.RemoveConsumer(task, c)
+
+	value, err := store.Get(queueRecordPrefix + task.ID())
+	if err != nil || value == nil {
+		t.Fatal("the record of the new task should be kept")
+	}
+}
+
+func TestBuildQueueClientLimit(t *testing.T) {
+	// no processes, the tasks are always pending
+	q := newBuildQueue(0)
+	q.clientMaxTasks = 2
+
+	q.Add(newTestBuildTask("a"), "127.0.0.1")
+	q.Add(newTestBuildTask("b"), "127.0.0.1")
+	c := q.Add(newTestBuildTask("c"), "127.0.0.1")
+	select {
+	case output := <-c.C:
+		if output.err != errTooManyBuilds {
+			t.Fatal("the client should be rejected, but", output.err)
+		}
+	default:
+		t.Fatal("the client should be rejected immediately")
+	}
+	if q.Len() != 2 {
+		t.Fatal("the rejected task should not be queued")
+	}
+
+	// joining an existing task and the tasks of other clients are not limited
+	q.Add(newTestBuildTask("a"), "127.0.0.1")
+	q.Add(newTestBuildTask("c"), "127.0.0.2")
+	q.Add(newTestBuildTask("d"), "")
+	if q.Len() != 4 {
+		t.Fatal("the tasks should be queued")
+	}
+
+	// the limit is released after the task is removed
+	task := newTestBuildTask("b")
+	q.RemoveConsumer(task, q.tasks[task.ID()].consumers[0])
+	q.Add(newTestBuildTask("e"), "127.0.0.1")
+	if q.Len() != 4 || q.clientTasks["127.0.0.1"] != 2 {
+		t.Fatal("the client should be able to add a new task")
+	}
+}
+
+func TestBuildQueueFairness(t *testing.T) {
+	q := newBuildQueue(8)
+	q.clientMaxProcesses = 2
+	push := func(id string, client string) *queueTask {
+		t := &queueTask{
+			BuildTask: &BuildTask{id: id},
+			client:    client,
+			createdAt: time.Now(),
+		}
+		t.el = q.list.PushBack(t)
+		q.tasks[id] = t
+		return t
+	}
+	run := func(t *queueTask) {
+		t.inProcess = true
+		q.processes = append(q.processes, t)
+	}
+
+	// a client requests many builds before others
+	for i := 0; i < 4; i++ {
+		push(fmt.Sprintf("a%d", i), "a")
+	}
+	push("b0", "b")
+	push("c0", "c")
+
+	now := time.Now()
+	expected := []string{"a0", "b0", "c0", "a1"}
+	for _, id := range expected {
+		task := q.pick(now)
+		if task == nil || task.ID() != id {
+			t.Fatalf("expected '%s' to be picked, but got %v", id, task)
+		}
+		run(task)
+	}
+	if task := q.pick(now); task != nil {
+		t.Fatalf("the client has too many running tasks, but picked '%s'", task.ID())
+	}
+}
@@ -27,6 +27,7 @@ var (
 	db           storage.DataBase
 	fs           storage.FileSystem
 	buildQueue   *BuildQueue
+	coordinator  *Coordinator
 	log          *logx.Logger
 	embedFS      EmbedFS
 	fetchLocks   sync.Map
@@ -107,13 +108,29 @@ func Serve(efs EmbedFS) {
 	if err != nil {
 		log.Fatalf("init storage(fs,%s): %v", cfg.Storage, err)
 	}
+	if !cfg.NoCompress {
+		// store the compressed variants of the build files to avoid compressing them on every request
+		fs = storage.NewCompressedFS(fs)
+	}
 
 	db, err = storage.OpenDB(cfg.Database)
 	if err != nil {
 		log.Fatalf("init storage(db,%s): %v", cfg.Database, err)
 	}
 
-	buildQueue = newBuildQueue(int(cfg.BuildConcurrency))
+	// the tasks are limited by the stage pools, e.g. a task can be installing while others are building
+	initStagePools()
+	buildQueue = newBuildQueue(int(cfg.InstallConcurrency + cfg.BuildConcurrency + cfg.TypesConcurrency))
+	buildQueue.failures = cache
+	buildQueue.clientMaxProcesses = int(cfg.ClientMaxBuilds)
+	buildQueue.clientMaxTasks = int(cfg.ClientMaxQueued)
+	if cfg.BuildCoordinator {
+		// the workers are authenticated by the auth secret
+		if cfg.AuthSecret == "" {
+			log.Fatal("the `buildCoordinator` config requires the `authSecret` config")
+		}
+		coordinator = newCoordinator(cfg.AuthSecret, 30*time.Second, 3)
+	}
 
 	var accessLogger *logx.Logger
 	if cfg.LogDir == "" {
@@ -139,6 +156,14 @@ func Serve(efs EmbedFS) {
 
 	go restorePurgeTimers(path.Join(cfg.WorkDir, "npm"))
 
+	// restore the build tasks that were pending before the server stopped
+	n, err := buildQueue.Restore(db)
+	if err != nil {
+		log.Errorf("restore build queue: %v", err)
+	} else if n > 0 {
+		log.Infof("restored %d build tasks", n)
+	}
+
 	if !cfg.NoCompress {
 		rex.Use(rex.Compression())
 	}
@@ -152,10 +177,11 @@ func Serve(efs EmbedFS) {
 				http.MethodGet,
 				http.MethodPost,
 			},
-			ExposedHeaders:   []string{"X-TypeScript-Types"},
+			ExposedHeaders:   []string{"X-TypeScript-Types", "X-Esm-Integrity"},
 			AllowCredentials: false,
 		}),
 		auth(cfg.AuthSecret),
+		workerHandler(),
 		apiHandler(),
 		esmHandler(),
 	)
@@ -187,6 +213,9 @@ func Serve(efs EmbedFS) {
 	}
 
 	// release resources
+	if coordinator != nil {
+		coordinator.Close()
+	}
 	kill(nsPidFile)
 	db.Close()
 	log.FlushBuffer()
@@ -2,7 +2,9 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -137,7 +139,17 @@ func apiHandler() rex.Handle {
 					return rex.Err(500, "internal server error")
 				}
 				if record == nil {
-					_, err = fs.WriteFile(path.Join("publish", id, "index.mjs"), bytes.NewReader(code))
+					checksums := map[string]string{}
+					writeFile := func(name string, r io.Reader) error {
+						savePath := path.Join("publish", id, name)
+						h := sha256.New()
+						_, err := fs.WriteFile(savePath, io.TeeReader(r, h))
+						if err == nil {
+							checksums[savePath] = hex.EncodeToString(h.Sum(nil))
+						}
+						return err
+					}
+					err = writeFile("index.mjs", bytes.NewReader(code))
 					if err == nil {
 						buf := bytes.NewBuffer(nil)
 						enc := json.NewEncoder(buf)
@@ -150,18 +162,19 @@ func apiHandler() rex.Handle {
 						}
 						if input.Types != "" {
 							pkgJson["types"] = "index.d.ts"
-							_, err = fs.WriteFile(path.Join("publish", id, "index.d.ts"), strings.NewReader(input.Types))
+							err = writeFile("index.d.ts", strings.NewReader(input.Types))
 						}
 						if err == nil {
 							err = enc.Encode(pkgJson)
 							if err == nil {
-								_, err = fs.WriteFile(path.Join("publish", id, "package.json"), buf)
+								err = writeFile("package.json", buf)
 							}
 						}
 					}
 					if err == nil {
 						err = db.Put(key, utils.MustEncodeJSON(map[string]interface{}{
 							"createdAt": time.Now().Unix(),
+							"checksums": checksums,
 						}))
 					}
 				}
@@ -185,6 +198,61 @@ func apiHandler() rex.Handle {
 					"url":       fmt.Sprintf("%s/~%s", cdnOrigin, id),
 					"bundleUrl": fmt.Sprintf("%s/~%s?bundle", cdnOrigin, id),
 				}
+			case "/prewarm":
+				// the prewarm api can't be used by anonymous users
+				if cfg.AuthSecret == "" {
+					return rex.Err(403, "the prewarm api requires the `authSecret` config")
+				}
+				var input PrewarmInput
+				defer ctx.R.Body.Close()
+				err := json.NewDecoder(ctx.R.Body).Decode(&input)
+				if err != nil {
+					return rex.Err(400, "failed to parse input: "+err.Error())
+				}
+				cdnOrigin := getCdnOrigin(ctx)
+				job, err := newPrewarmJob(input, cdnOrigin)
+				if err != nil {
+					return rex.Err(400, err.Error())
+				}
+				statusUrl := fmt.Sprintf("%s%s/_prewarm/%s", cdnOrigin, cfg.BasePath, job.id)
+				ctx.SetHeader("Location", statusUrl)
+				return rex.Status(http.StatusAccepted, map[string]interface{}{
+					"id":        job.id,
+					"statusUrl": statusUrl,
+				})
+			case "/importmap":
+				var input ImportMapInput
+				defer ctx.R.Body.Close()
+				err := json.NewDecoder(ctx.R.Body).Decode(&input)
+				if err != nil {
+					return rex.Err(400, "failed to parse input: "+err.Error())
+				}
+				g, err := newImportMapGenerator(input, getCdnOrigin(ctx))
+				if err != nil {
+					return rex.Err(400, err.Error())
+				}
+				err = g.resolve(input)
+				if err != nil {
+					return rex.Err(400, err.Error())
+				}
+				entries := g.entries()
+				builds, err := g.build(entries, ctx.RemoteIP())
+				if err != nil {
+					if err == errTooManyBuilds {
+						ctx.SetHeader("Retry-After", "10")
+						return rex.Err(http.StatusTooManyRequests, err.Error())
+					}
+					if err == errImportMapTimeout {
+						return rex.Err(http.StatusRequestTimeout, err.Error())
+					}
+					return rex.Err(500, err.Error())
+				}
+				im, err := g.generate(entries, builds, input.Integrity)
+				if err != nil {
+					return rex.Err(500, err.Error())
+				}
+				ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+				return im
 			default:
 				return rex.Err(404, "not found")
 			}
@@ -233,6 +301,31 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// stream the progress of a build task by the build ID, e.g. `/_progress/v127/react@18.2.0/es2022/react.mjs`
+		if strings.HasPrefix(pathname, "/_progress/") {
+			return progressHandler(ctx, strings.TrimPrefix(pathname, "/_progress/"))
+		}
+
+		// the status of a build task that is added in the async mode
+		if strings.HasPrefix(pathname, "/_status/") {
+			return buildStatusHandler(ctx, cdnOrigin, strings.TrimPrefix(pathname, "/_status/"))
+		}
+
+		// the metadata of a build, e.g. the SRI hashes of the build files
+		if strings.HasPrefix(pathname, "/_meta/") {
+			return buildMetaHandler(ctx, cdnOrigin, strings.TrimPrefix(pathname, "/_meta/"))
+		}
+
+		// the progress of a prewarm job
+		if strings.HasPrefix(pathname, "/_prewarm/") {
+			v, ok := prewarmJobs.Load(strings.TrimPrefix(pathname, "/_prewarm/"))
+			if !ok {
+				return rex.Status(404, "prewarm job not found")
+			}
+			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return v.(*prewarmJob).status()
+		}
+
 		// static routes
 		switch pathname {
 		case "/":
@@ -278,6 +371,7 @@ func esmHandler() rex.Handle {
 						"dev":       t.Dev,
 						"inProcess": t.inProcess,
 						"pkg":       t.Pkg.String(),
+						"priority":  t.priority.String(),
 						"stage":     t.stage,
 						"target":    t.Target,
 					}
@@ -310,14 +404,24 @@ func esmHandler() rex.Handle {
 				return err
 			}
 
-			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
-			return map[string]interface{}{
-				"buildQueue":  q[:i],
+			status := map[string]interface{}{
+				"buildQueue": q[:i],
+				"stagePools": map[string]interface{}{
+					"install": installPool.stats(),
+					"build":   buildPool.stats(),
+					"types":   typesPool.stats(),
+				},
 				"purgeTimers": n,
 				"ns":          string(out),
 				"version":     CTX_VERSION,
 				"uptime":      time.Since(startTime).String(),
 			}
+			if sc, ok := cache.(storage.StatsCache); ok {
+				status["cache"] = sc.Stats()
+			}
+
+			ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
+			return status
 
 		case "/esma-target":
 			return getTargetByUA(ctx.R.UserAgent())
@@ -521,7 +625,8 @@ func esmHandler() rex.Handle {
 			extname := path.Ext(reqPkg.Subpath)
 			dir := path.Join(cfg.WorkDir, "npm", reqPkg.Name+"@"+reqPkg.Version)
 			if !dirExists(dir) {
-				err := installPackage(dir, reqPkg)
+				// not canceled by the client, the installed dir is reused by the following requests
+				err := installPackage(context.Background(), dir, reqPkg)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
@@ -736,6 +841,9 @@ func esmHandler() rex.Handle {
 				c := buildQueue.Add(task, ctx.RemoteIP())
 				select {
 				case output := <-c.C:
+					if output.err == errTooManyBuilds {
+						return rex.Status(http.StatusTooManyRequests, output.err.Error())
+					}
 					if output.err != nil {
 						return rex.Status(500, "Fail to install package: "+output.err.Error())
 					}
@@ -746,8 +854,13 @@ func esmHandler() rex.Handle {
 						}
 						return rex.Status(404, "File Not Found")
 					}
-				case <-time.After(time.Minute):
+				case <-ctx.R.Context().Done():
+					// the client is gone, the build is canceled if nobody else is waiting for it
 					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "canceled")
+				case <-time.After(time.Minute):
+					// keep building in background, so the retry can get the build
+					buildQueue.Detach(task, c, PriorityBackground)
 					ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are downloading package hardly, please try again later!")
 				}
@@ -787,17 +900,35 @@ func esmHandler() rex.Handle {
 				}
 			}
 
+			// verify the checksum of the build artifact, the corrupted build will be rebuilt
+			var checksum string
+			var integrity string
+			if err == nil && reqType == "builds" {
+				var a verifiedArtifact
+				a, err = verifyBuildArtifact(savePath)
+				if err == errChecksumMismatch {
+					if strings.HasSuffix(pathname, ".map") {
+						return rex.Status(404, "Not found")
+					}
+					err = storage.ErrNotFound
+				} else if err != nil && err != storage.ErrNotFound {
+					return rex.Status(500, err.Error())
+				}
+				checksum = a.checksum
+				integrity = a.integrity
+			}
+
 			if err == nil {
+				if checksum != "" {
+					ctx.SetHeader("X-Esm-Checksum", "sha256-"+checksum)
+				}
 				r, err := fs.OpenFile(savePath)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
-				if reqType == "types" {
-					ctx.SetHeader("Content-Type", "application/typescript; charset=utf-8")
-				} else if endsWith(pathname, ".js", ".mjs", ".jsx", ".ts", ".mts", ".tsx") {
-					ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
-				} else if strings.HasSuffix(savePath, ".map") {
-					ctx.SetHeader("Content-Type", "application/json; charset=utf-8")
+				contentType := getBuildFileContentType(reqType, pathname, savePath)
+				if contentType != "" {
+					ctx.SetHeader("Content-Type", contentType)
 				}
 				ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable")
 				if ctx.Form.Has("worker") && reqType == "builds" {
@@ -810,6 +941,25 @@ func esmHandler() rex.Handle {
 					ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
 					return fmt.Sprintf(`export default function workerFactory(inject) { const blob = new Blob([%s, typeof inject === "string" ? "\n// inject\n" + inject : ""], { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module" })}`, utils.MustEncodeJSON(string(code)))
 				}
+				if integrity != "" {
+					ctx.SetHeader("X-Esm-Integrity", integrity)
+				}
+				// send the precompressed variant directly, and skip the on-the-fly compression, the content
+				// type can't be sniffed from the compressed content
+				if cfs, ok := fs.(storage.CompressedFileSystem); ok && contentType != "" {
+					if encoding := getAcceptEncoding(ctx.R.Header.Get("Accept-Encoding")); encoding != "" {
+						cr, err := cfs.OpenCompressedFile(savePath, encoding)
+						if err == nil {
+							r.Close()
+							ctx.SetHeader("Content-Encoding", encoding)
+							ctx.AddHeader("Vary", "Accept-Encoding")
+							return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+								defer cr.Close()
+								http.ServeContent(w, r, savePath, fi.ModTime(), cr)
+							})
+						}
+					}
+				}
 				return rex.Content(savePath, fi.ModTime(), r) // auto closed
 			}
 		}
@@ -840,15 +990,12 @@ func esmHandler() rex.Handle {
 					}
 					return rex.Status(400, fmt.Sprintf("Invalid deps query: %v not found", p))
 				}
-				if reqPkg.Name == "react-dom" && m.Name == "react" {
-					// the `react` version always matches `react-dom` version
-					continue
-				}
-				if !deps.Has(m.Name) && m.Name != reqPkg.Name {
+				if !deps.Has(m.Name) {
 					deps = append(deps, m)
 				}
 			}
 		}
+		deps = pkgDeps(deps, reqPkg)
 
 		// check `?exports` query
 		treeShaking := newStringSet()
@@ -963,13 +1110,7 @@ func esmHandler() rex.Handle {
 		}
 
 		// clear build args for main entry of stable builds
-		if stableBuild[reqPkg.Name] && reqPkg.Submodule == "" {
-			buildArgs = BuildArgs{
-				external:    newStringSet(),
-				treeShaking: newStringSet(),
-				conditions:  buildArgs.conditions,
-			}
-		}
+		buildArgs = fixStableBuildArgs(buildArgs, reqPkg)
 
 		// check if it's build path
 		isBarePath := false
@@ -1054,6 +1195,13 @@ func esmHandler() rex.Handle {
 					}
 				}
 				fi, err = fs.Stat(savePath)
+				if err == nil {
+					// the corrupted types will be rebuilt
+					err = verifyTypesArtifact(savePath)
+					if err == errChecksumMismatch {
+						err = storage.ErrNotFound
+					}
+				}
 				return savePath, fi, err
 			}
 			_, _, err := findDts()
@@ -1068,11 +1216,19 @@ func esmHandler() rex.Handle {
 				c := buildQueue.Add(task, ctx.RemoteIP())
 				select {
 				case output := <-c.C:
+					if output.err == errTooManyBuilds {
+						return rex.Status(http.StatusTooManyRequests, output.err.Error())
+					}
 					if output.err != nil {
 						return rex.Status(500, "types: "+output.err.Error())
 					}
-				case <-time.After(time.Minute):
+				case <-ctx.R.Context().Done():
+					// the client is gone, the build is canceled if nobody else is waiting for it
 					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "canceled")
+				case <-time.After(time.Minute):
+					// keep building in background, so the retry can get the build
+					buildQueue.Detach(task, c, PriorityBackground)
 					ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are transforming the types hardly, please try again later!")
 				}
@@ -1123,9 +1279,11 @@ func esmHandler() rex.Handle {
 			}
 
 			// if the previous build exists and is not pin/bare mode, then build current module in backgound,
-			// or wait the current build task for 60 seconds
+			// or return the status url in the async mode, or wait the current build task for 60 seconds
 			if esm != nil {
 				buildQueue.Add(task, "")
+			} else if isAsyncRequest(ctx) {
+				return buildAsync(ctx, cdnOrigin, task)
 			} else {
 				c := buildQueue.Add(task, ctx.RemoteIP())
 				select {
@@ -1134,8 +1292,13 @@ func esmHandler() rex.Handle {
 						return throwErrorJS(ctx, output.err)
 					}
 					esm = output.meta
-				case <-time.After(time.Minute):
+				case <-ctx.R.Context().Done():
+					// the client is gone, the build is canceled if nobody else is waiting for it
 					buildQueue.RemoveConsumer(task, c)
+					return rex.Status(http.StatusRequestTimeout, "canceled")
+				case <-time.After(time.Minute):
+					// keep building in background, so the retry can get the build
+					buildQueue.Detach(task, c, PriorityBackground)
 					ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 					return rex.Status(http.StatusRequestTimeout, "timeout, we are building the package hardly, please try again later!")
 				}
@@ -1211,9 +1374,21 @@ func esmHandler() rex.Handle {
 			if endsWith(savePath, ".mjs", ".js") {
 				ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
 			}
+			if integrity := esm.Integrity[savePath]; integrity != "" {
+				ctx.SetHeader("X-Esm-Integrity", integrity)
+			}
 			return rex.Content(savePath, fi.ModTime(), f) // auto closed
 		}
 
+		// the full import graph of the entry for the `modulepreload` links
+		var preloadUrls []string
+		preloadComplete := true
+		if !isWorker {
+			var graph []string
+			graph, preloadComplete = getPreloadGraph(taskID, esm)
+			preloadUrls = getPreloadUrls(cdnOrigin, taskID, graph)
+		}
+
 		buf := bytes.NewBuffer(nil)
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, EOL)
 
@@ -1221,7 +1396,7 @@ func esmHandler() rex.Handle {
 			fmt.Fprintf(buf, `export { default } from "%s%s/%s?worker";`, cdnOrigin, cfg.BasePath, taskID)
 		} else {
 			if len(esm.Deps) > 0 {
-				// TODO: lookup deps of deps
+				// the deps of deps are prebuilt in background when the build is done, see `prebuildDeps`
 				ctx.SetHeader("X-Esm-Deps", strings.Join(sliceMap(esm.Deps, func(dep string) string {
 					if strings.HasPrefix(dep, "/") {
 						dep = fmt.Sprintf("%s%s%s", cdnOrigin, cfg.BasePath, dep)
@@ -1266,6 +1441,29 @@ func esmHandler() rex.Handle {
 		if targetFromUA {
 			ctx.AddHeader("Vary", "User-Agent")
 		}
+
+		// return a `<link rel="modulepreload">` block of the import graph from `?preload-html`
+		if ctx.Form.Has("preload-html") && !isWorker {
+			ctx.SetHeader("Content-Type", "text/html; charset=utf-8")
+			if !preloadComplete && !fallback {
+				// the graph may grow when the deps are built
+				ctx.SetHeader("Cache-Control", "public, max-age=60")
+			}
+			if ctx.R.Method == http.MethodHead {
+				return []byte{}
+			}
+			return preloadHTML(preloadUrls)
+		}
+
+		// the incomplete graph is not sent with the long-lived response
+		if preloadComplete {
+			if len(preloadUrls) > preloadMaxLinks {
+				preloadUrls = preloadUrls[:preloadMaxLinks]
+			}
+			for _, url := range preloadUrls {
+				ctx.AddHeader("Link", fmt.Sprintf("<%s>; rel=modulepreload", url))
+			}
+		}
 		ctx.SetHeader("Content-Length", strconv.Itoa(buf.Len()))
 		ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
 		if ctx.R.Method == http.MethodHead {
@@ -1275,6 +1473,24 @@ func esmHandler() rex.Handle {
 	}
 }
 
+// getCdnOrigin returns the origin of the CDN by the `X-Real-Origin` header, the `origin` config
+// or the request host.
+func getCdnOrigin(ctx *rex.Context) string {
+	cdnOrigin := ctx.R.Header.Get("X-Real-Origin")
+	if cdnOrigin == "" {
+		cdnOrigin = cfg.Origin
+	}
+	if cdnOrigin == "" {
+		proto := "http"
+		if ctx.R.TLS != nil {
+			proto = "https"
+		}
+		// use the request host as the origin if not set in config.json
+		cdnOrigin = fmt.Sprintf("%s://%s", proto, ctx.R.Host)
+	}
+	return cdnOrigin
+}
+
 func auth(secret string) rex.Handle {
 	return func(ctx *rex.Context) interface{} {
 		if secret != "" && ctx.R.Header.Get("Authorization") != "Bearer "+secret {
@@ -1304,9 +1520,20 @@ func throwErrorJS(ctx *rex.Context, err error) interface{} {
 		"\n",
 	)
 	fmt.Fprintf(buf, "export default null;\n")
+	status := 500
+	var failure *BuildFailure
+	if errors.As(err, &failure) {
+		retryAfter := (failure.RetryAt - time.Now().UnixMilli() + 999) / 1000
+		if retryAfter > 0 {
+			ctx.SetHeader("Retry-After", strconv.FormatInt(retryAfter, 10))
+		}
+	} else if err == errTooManyBuilds {
+		status = http.StatusTooManyRequests
+		ctx.SetHeader("Retry-After", "10")
+	}
 	ctx.SetHeader("Cache-Control", "private, no-store, no-cache, must-revalidate")
 	ctx.SetHeader("Content-Type", "application/javascript; charset=utf-8")
-	return rex.Status(500, buf)
+	return rex.Status(status, buf)
 }
 
 func getTypesRoot(cdnOrigin string) string {
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// SnapshotManifest is the first entry of a snapshot archive, the counts are recorded in the trailer.
+type SnapshotManifest struct {
+	Format       int   `json:"format"`
+	EsmVersion   int   `json:"esmVersion"`
+	BuildVersion int   `json:"buildVersion"`
+	CreatedAt    int64 `json:"createdAt"`
+	Records      int   `json:"records"`
+	Files        int   `json:"files"`
+}
+
+const snapshotFormat = 1
+
+const (
+	snapshotManifestName = "manifest.json"
+	snapshotTrailerName  = "trailer.json"
+)
+
+const snapshotUsage = `Usage:
+  esmd snapshot export [-config config.json] [-version %d] [-o snapshot.tar.gz]
+  esmd snapshot import [-config config.json] snapshot.tar.gz
+`
+
+// Snapshot runs the `esmd snapshot` command that exports/imports the builds of a build version.
+func Snapshot(args []string) {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintf(os.Stderr, snapshotUsage, VERSION)
+		os.Exit(1)
+	}
+
+	var (
+		cfile        string
+		buildVersion int
+		output       string
+	)
+	cmd := args[0]
+	flags := flag.NewFlagSet("snapshot "+cmd, flag.ExitOnError)
+	flags.StringVar(&cfile, "config", "config.json", "the config file path")
+	if cmd == "export" {
+		flags.IntVar(&buildVersion, "version", VERSION, "the build version to export")
+		flags.StringVar(&output, "o", "-", "the output file path, '-' for stdout")
+	}
+	flags.Parse(args[1:])
+
+	// the messages are printed to stderr, since the archive may be written to stdout
+	var err error
+	if fileExists(cfile) {
+		cfg, err = config.Load(cfile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	} else {
+		cfg = config.Default()
+	}
+	// the startup jobs of the storage are run by the server
+	fs, err = storage.OpenFSNoInit(cfg.Storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init storage(fs,%s): %v\n", cfg.Storage, err)
+		os.Exit(1)
+	}
+	if !cfg.NoCompress {
+		fs = storage.NewCompressedFS(fs)
+	}
+	db, err = storage.OpenDB(cfg.Database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init storage(db,%s): %v\n", cfg.Database, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var manifest *SnapshotManifest
+	if cmd == "export" {
+		var w io.WriteCloser = os.Stdout
+		if output != "-" {
+			w, err = os.Create(output)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		manifest, err = exportSnapshot(w, buildVersion)
+		if e := w.Close(); err == nil {
+			err = e
+		}
+	} else {
+		var r io.ReadCloser = os.Stdin
+		if name := flags.Arg(0); name != "" && name != "-" {
+			r, err = os.Open(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		manifest, err = importSnapshot(r)
+		r.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot %s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "snapshot %sed: v%d, %d records, %d files\n", cmd, manifest.BuildVersion, manifest.Records, manifest.Files)
+}
+
+// exportSnapshot writes the build files and the db records of the build version to a gzipped tar archive,
+// the files are written before the records so the imported records never point to missing files. The
+// manifest is written as the first entry without the counts, and as the last entry(trailer) with the
+// counts of the written entries, since the records may be changed while exporting.
+func exportSnapshot(w io.Writer, buildVersion int) (manifest *SnapshotManifest, err error) {
+	files, err := listSnapshotFiles(buildVersion)
+	if err != nil {
+		return
+	}
+
+	manifest = &SnapshotManifest{
+		Format:       snapshotFormat,
+		EsmVersion:   VERSION,
+		BuildVersion: buildVersion,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	data, _ := json.Marshal(manifest)
+	err = writeTarEntry(tw, snapshotManifestName, int64(len(data)), now, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	for _, name := range files {
+		var stat storage.FileStat
+		stat, err = fs.Stat(name)
+		if err != nil {
+			return
+		}
+		var r io.ReadSeekCloser
+		r, err = fs.OpenFile(name)
+		if err != nil {
+			return
+		}
+		err = writeTarEntry(tw, "fs/"+name, stat.Size(), stat.ModTime(), r)
+		r.Close()
+		if err != nil {
+			return
+		}
+		manifest.Files++
+	}
+
+	for _, prefix := range snapshotRecordPrefixes(buildVersion) {
+		err = db.Scan(prefix, func(key string, value []byte) error {
+			// the checksums of the types are recorded by the save paths
+			if prefix == "types/" && !isSnapshotTypesPath(key, buildVersion) {
+				return nil
+			}
+			manifest.Records++
+			return writeTarEntry(tw, "db/"+key, int64(len(value)), now, bytes.NewReader(value))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	data, _ = json.Marshal(manifest)
+	err = writeTarEntry(tw, snapshotTrailerName, int64(len(data)), now, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gw.Close()
+	}
+	return
+}
+
+// importSnapshot restores the files and the records of the snapshot archive to the configured storage.
+// The records are spooled to a temp file and stored after the trailer is verified, so an incomplete
+// snapshot doesn't import the records.
+func importSnapshot(r io.Reader) (manifest *SnapshotManifest, err error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != snapshotManifestName {
+		return nil, errors.New("invalid snapshot: missing manifest")
+	}
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %v", err)
+	}
+	if manifest.Format != snapshotFormat {
+		return nil, fmt.Errorf("unsupported snapshot format %d", manifest.Format)
+	}
+
+	spool, err := os.CreateTemp("", "esm-snapshot-*.tar")
+	if err != nil {
+		return
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	sw := tar.NewWriter(spool)
+
+	var trailer *SnapshotManifest
+	records := 0
+	files := 0
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg || strings.Contains(hdr.Name, "..") {
+			return nil, fmt.Errorf("invalid snapshot entry '%s'", hdr.Name)
+		}
+		if hdr.Name == snapshotTrailerName {
+			err = json.NewDecoder(tr).Decode(&trailer)
+			if err != nil {
+				return nil, fmt.Errorf("invalid snapshot trailer: %v", err)
+			}
+		} else if strings.HasPrefix(hdr.Name, "fs/") {
+			_, err = fs.WriteFile(strings.TrimPrefix(hdr.Name, "fs/"), tr)
+			if err != nil {
+				return
+			}
+			files++
+		} else if strings.HasPrefix(hdr.Name, "db/") {
+			err = writeTarEntry(sw, hdr.Name, hdr.Size, hdr.ModTime, tr)
+			if err != nil {
+				return
+			}
+			records++
+		}
+	}
+
+	if trailer == nil || records != trailer.Records || files != trailer.Files {
+		if trailer == nil {
+			trailer = &SnapshotManifest{}
+		}
+		return nil, fmt.Errorf("incomplete snapshot: %d/%d records, %d/%d files", records, trailer.Records, files, trailer.Files)
+	}
+
+	err = sw.Close()
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return
+	}
+	sr := tar.NewReader(spool)
+	for {
+		hdr, err = sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+		var value []byte
+		value, err = ioutil.ReadAll(sr)
+		if err != nil {
+			return
+		}
+		err = db.Put(strings.TrimPrefix(hdr.Name, "db/"), value)
+		if err != nil {
+			return
+		}
+	}
+	return trailer, nil
+}
+
+// listSnapshotFiles lists the files of the published modules `publish/...`, the build files `builds/v{N}/...`
+// and the type files `types/{host}/v{N}/...`.
+func listSnapshotFiles(buildVersion int) (files []string, err error) {
+	files, err = fs.List("publish/")
+	if err != nil {
+		return
+	}
+	builds, err := fs.List(fmt.Sprintf("builds/v%d/", buildVersion))
+	if err != nil {
+		return
+	}
+	files = append(files, builds...)
+	types, err := fs.List("types/")
+	if err != nil {
+		return
+	}
+	for _, name := range types {
+		if isSnapshotTypesPath(name, buildVersion) {
+			files = append(files, name)
+		}
+	}
+	return
+}
+
+// isSnapshotTypesPath checks if the types path `types/{host}/v{N}/...` belongs to the build version.
+func isSnapshotTypesPath(name string, buildVersion int) bool {
+	a := strings.SplitN(name, "/", 4)
+	return len(a) == 4 && a[2] == fmt.Sprintf("v%d", buildVersion)
+}
+
+// snapshotRecordPrefixes returns the key prefixes of the records to export, the records of the published
+// modules are included since the `~` builds depend on them, and the checksums of the types.
+func snapshotRecordPrefixes(buildVersion int) []string {
+	prefixes := []string{"publish-", "types/", fmt.Sprintf("v%d/", buildVersion)}
+	if buildVersion == STABLE_VERSION {
+		prefixes = append(prefixes, "stable/")
+	}
+	return prefixes
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) (err error) {
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(tw, r)
+	return
+}
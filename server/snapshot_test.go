@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestSnapshot(t *testing.T) {
+	var err error
+	dir := t.TempDir()
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []int{VERSION - 1, VERSION} {
+		id := fmt.Sprintf("v%d/react@18.2.0/es2022/react.mjs", v)
+		db.Put(id, []byte(`{"d":true}`))
+		fs.WriteFile("builds/"+id, strings.NewReader("export default {}"))
+		fs.WriteFile("builds/"+id+".map", strings.NewReader("{}"))
+		fs.WriteFile(fmt.Sprintf("types/esm.sh/v%d/@types/react@18.2.0/index.d.ts", v), strings.NewReader("export {}"))
+	}
+	db.Put("publish-abc", []byte("{}"))
+	fs.WriteFile("publish/abc/index.mjs", strings.NewReader("export default 1"))
+	db.Put("queue/foo", []byte("{}"))
+
+	buf := bytes.NewBuffer(nil)
+	manifest, err := exportSnapshot(buf, VERSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Records != 2 || manifest.Files != 4 {
+		t.Fatalf("invalid manifest %+v", manifest)
+	}
+	db.Close()
+
+	// import into the empty storage
+	fs, err = storage.OpenFS("local:" + filepath.Join(dir, "storage2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = storage.OpenDB("bolt:" + filepath.Join(dir, "esm2.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	manifest, err = importSnapshot(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BuildVersion != VERSION {
+		t.Fatalf("invalid build version %d", manifest.BuildVersion)
+	}
+	id := fmt.Sprintf("v%d/react@18.2.0/es2022/react.mjs", VERSION)
+	value, err := db.Get(id)
+	if err != nil || string(value) != `{"d":true}` {
+		t.Fatalf("invalid record '%s'", value)
+	}
+	r, err := fs.OpenFile("builds/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "export default {}" {
+		t.Fatalf("invalid file content '%s'", data)
+	}
+	paths, _ := fs.List("")
+	if len(paths) != 4 {
+		t.Fatalf("only the files of v%d and the published modules should be imported, but %v", VERSION, paths)
+	}
+	if value, _ := db.Get("publish-abc"); value == nil {
+		t.Fatal("the publish record should be imported")
+	}
+	if value, _ := db.Get("queue/foo"); value != nil {
+		t.Fatal("the queue record should not be imported")
+	}
+
+	// truncated archive, the records are not imported
+	db.Delete(id)
+	_, err = importSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-64]))
+	if err == nil {
+		t.Fatal("should be failed to import the truncated snapshot")
+	}
+	if value, _ := db.Get(id); value != nil {
+		t.Fatal("the records of the truncated snapshot should not be imported")
+	}
+}
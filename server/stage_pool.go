@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+)
+
+// stagePool limits the concurrency of a build stage, e.g. the network-bound `install` stage
+// and the CPU-bound `build` stage, a nil pool has no limit.
+type stagePool struct {
+	slots chan struct{}
+}
+
+var (
+	installPool *stagePool
+	buildPool   *stagePool
+	typesPool   *stagePool
+)
+
+func newStagePool(concurrency int) *stagePool {
+	if concurrency <= 0 {
+		return nil
+	}
+	return &stagePool{slots: make(chan struct{}, concurrency)}
+}
+
+// acquire waits for a free slot of the pool until the context is done.
+func (p *stagePool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *stagePool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
+
+// stats returns the number of the running slots and the capacity of the pool.
+func (p *stagePool) stats() map[string]int {
+	if p == nil {
+		return nil
+	}
+	return map[string]int{"running": len(p.slots), "capacity": cap(p.slots)}
+}
+
+// stagePool returns the pool of the build stage of the task.
+func (task *BuildTask) stagePool() *stagePool {
+	if task.Target == "types" {
+		return typesPool
+	}
+	return buildPool
+}
+
+// initStagePools creates the pools by the config.
+func initStagePools() {
+	installPool = newStagePool(int(cfg.InstallConcurrency))
+	buildPool = newStagePool(int(cfg.BuildConcurrency))
+	typesPool = newStagePool(int(cfg.TypesConcurrency))
+}
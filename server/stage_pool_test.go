@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStagePool(t *testing.T) {
+	var nilPool *stagePool
+	if nilPool.acquire(context.Background()) != nil {
+		t.Fatal("the nil pool should have no limit")
+	}
+	nilPool.release()
+
+	pool := newStagePool(2)
+	for i := 0; i < 2; i++ {
+		if err := pool.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatal("the full pool should block until the context is done, but", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		pool.acquire(context.Background())
+		close(acquired)
+	}()
+	pool.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("the released slot should be acquired")
+	}
+	if stats := pool.stats(); stats["running"] != 2 || stats["capacity"] != 2 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
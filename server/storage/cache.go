@@ -17,6 +17,21 @@ type Cache interface {
 	Flush() error
 }
 
+// CacheStats is the statistics of a cache, see `StatsCache`.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Size      int64 `json:"size"`
+}
+
+// StatsCache is the interface implemented by caches that can report statistics.
+type StatsCache interface {
+	Cache
+	Stats() CacheStats
+}
+
 type CacheDriver interface {
 	Open(addr string, args url.Values) (cache Cache, err error)
 }
@@ -1,34 +1,50 @@
 package storage
 
 import (
+	"container/list"
 	"errors"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type mValue struct {
+	key       string
 	data      []byte
 	expiredAt int64
 }
 
-func (v mValue) isExpired() bool {
+func (v *mValue) isExpired() bool {
 	return v.expiredAt > 0 && time.Now().UnixNano() > v.expiredAt
 }
 
+func (v *mValue) size() int64 {
+	return int64(len(v.key) + len(v.data))
+}
+
+// mCache is a memory cache with LRU eviction, the least recently used records are evicted
+// when the `maxSize` or `maxEntries` limit is reached. No limit by default.
 type mCache struct {
-	lock       sync.RWMutex
+	lock       sync.Mutex
 	gcInterval time.Duration
 	gcTimer    *time.Timer
-	storage    map[string]mValue
+	maxSize    int64
+	maxEntries int
+	size       int64
+	lru        *list.List
+	storage    map[string]*list.Element
+	hits       int64
+	misses     int64
+	evictions  int64
 }
 
 func (mc *mCache) Has(key string) (bool, error) {
-	mc.lock.RLock()
-	s, ok := mc.storage[key]
-	mc.lock.RUnlock()
+	mc.lock.Lock()
+	el, ok := mc.storage[key]
+	mc.lock.Unlock()
 
-	if ok && s.isExpired() {
+	if ok && el.Value.(*mValue).isExpired() {
 		go mc.Delete(key)
 		return false, nil
 	}
@@ -37,20 +53,26 @@ func (mc *mCache) Has(key string) (bool, error) {
 }
 
 func (mc *mCache) Get(key string) (value []byte, err error) {
-	mc.lock.RLock()
-	s, ok := mc.storage[key]
-	mc.lock.RUnlock()
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	el, ok := mc.storage[key]
 	if !ok {
+		mc.misses++
 		err = ErrNotFound
 		return
 	}
 
+	s := el.Value.(*mValue)
 	if s.isExpired() {
-		mc.Delete(key)
+		mc.remove(el)
+		mc.misses++
 		err = ErrExpired
 		return
 	}
 
+	mc.lru.MoveToFront(el)
+	mc.hits++
 	value = s.data
 	return
 }
@@ -59,10 +81,27 @@ func (mc *mCache) Set(key string, value []byte, ttl time.Duration) error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
+	if el, ok := mc.storage[key]; ok {
+		mc.remove(el)
+	}
+
+	v := &mValue{key: key, data: value}
 	if ttl > 0 {
-		mc.storage[key] = mValue{value, time.Now().Add(ttl).UnixNano()}
-	} else {
-		mc.storage[key] = mValue{value, 0}
+		v.expiredAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	// the record is too large to be cached
+	if mc.maxSize > 0 && v.size() > mc.maxSize {
+		mc.evictions++
+		return nil
+	}
+
+	mc.storage[key] = mc.lru.PushFront(v)
+	mc.size += v.size()
+
+	for (mc.maxSize > 0 && mc.size > mc.maxSize) || (mc.maxEntries > 0 && mc.lru.Len() > mc.maxEntries) {
+		mc.remove(mc.lru.Back())
+		mc.evictions++
 	}
 	return nil
 }
@@ -71,7 +110,9 @@ func (mc *mCache) Delete(key string) error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	delete(mc.storage, key)
+	if el, ok := mc.storage[key]; ok {
+		mc.remove(el)
+	}
 	return nil
 }
 
@@ -79,19 +120,42 @@ func (mc *mCache) Flush() error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	mc.storage = map[string]mValue{}
+	mc.storage = map[string]*list.Element{}
+	mc.lru.Init()
+	mc.size = 0
 	return nil
 }
 
+// Stats returns the hit, miss and eviction counters of the cache.
+func (mc *mCache) Stats() CacheStats {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	return CacheStats{
+		Hits:      mc.hits,
+		Misses:    mc.misses,
+		Evictions: mc.evictions,
+		Entries:   mc.lru.Len(),
+		Size:      mc.size,
+	}
+}
+
+// remove removes the record from the cache, the caller must hold the lock.
+func (mc *mCache) remove(el *list.Element) {
+	v := mc.lru.Remove(el).(*mValue)
+	delete(mc.storage, v.key)
+	mc.size -= v.size()
+}
+
 func (mc *mCache) gc() {
 	mc.gcTimer = time.AfterFunc(mc.gcInterval, mc.gc)
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	for key, d := range mc.storage {
-		if d.isExpired() {
-			delete(mc.storage, key)
+	for _, el := range mc.storage {
+		if el.Value.(*mValue).isExpired() {
+			mc.remove(el)
 		}
 	}
 }
@@ -104,9 +168,25 @@ func (mcd *mcDriver) Open(region string, options url.Values) (Cache, error) {
 		return nil, errors.New("invalid gcInterval value")
 	}
 
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 0)
+	if err != nil {
+		return nil, errors.New("invalid maxSize value")
+	}
+
+	maxEntries := 0
+	if v := options.Get("maxEntries"); v != "" {
+		maxEntries, err = strconv.Atoi(v)
+		if err != nil || maxEntries < 0 {
+			return nil, errors.New("invalid maxEntries value")
+		}
+	}
+
 	mc := &mCache{
-		storage:    map[string]mValue{},
+		storage:    map[string]*list.Element{},
+		lru:        list.New(),
 		gcInterval: gcInterval,
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
 	}
 	if gcInterval >= time.Second {
 		mc.gcTimer = time.AfterFunc(gcInterval, mc.gc)
@@ -41,3 +41,53 @@ func TestMemCache(t *testing.T) {
 		t.Fatal("should be expired error, but", err)
 	}
 }
+
+func TestMemCacheLRU(t *testing.T) {
+	cache, err := OpenCache("memory:test?maxEntries=3&maxSize=1kb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mc, ok := cache.(*mCache)
+	if !ok {
+		t.Fatal("not a memory cache")
+	}
+	if mc.maxEntries != 3 || mc.maxSize != 1024 {
+		t.Fatalf("invalid limits maxEntries=%d maxSize=%d", mc.maxEntries, mc.maxSize)
+	}
+
+	cache.Set("a", []byte("1"), 0)
+	cache.Set("b", []byte("2"), 0)
+	cache.Set("c", []byte("3"), 0)
+	// make "a" recently used
+	cache.Get("a")
+	cache.Set("d", []byte("4"), 0)
+
+	_, err = cache.Get("b")
+	if err != ErrNotFound {
+		t.Fatal("the least recently used record 'b' should be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, err := cache.Get(key); err != nil {
+			t.Fatalf("record '%s' should be cached, but %v", key, err)
+		}
+	}
+
+	// evict by size
+	cache.Set("e", make([]byte, 1022), 0)
+	stats := mc.Stats()
+	if stats.Entries != 1 || stats.Size != 1023 {
+		t.Fatalf("invalid stats %+v after size eviction", stats)
+	}
+
+	// too large to be cached
+	cache.Set("f", make([]byte, 2000), 0)
+	if _, err := cache.Get("f"); err != ErrNotFound {
+		t.Fatal("the large record should not be cached")
+	}
+
+	stats = mc.Stats()
+	if stats.Hits != 4 || stats.Misses != 2 || stats.Evictions != 5 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+}
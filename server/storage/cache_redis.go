@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+// rCache stores records with the expiration time as the 8 bytes prefix of the value,
+// expired records are kept in redis for the `grace` period to report `ErrExpired` like the memory cache.
+type rCache struct {
+	pool   *redisPool
+	prefix string
+	grace  time.Duration
+}
+
+func (rc *rCache) Has(key string) (bool, error) {
+	_, err := rc.Get(key)
+	if err == ErrNotFound || err == ErrExpired {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (rc *rCache) Get(key string) (value []byte, err error) {
+	ret, err := rc.pool.do("GET", rc.prefix+key)
+	if err != nil {
+		return
+	}
+	data, ok := ret.([]byte)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	if len(data) < 8 {
+		rc.Delete(key)
+		err = ErrNotFound
+		return
+	}
+
+	expiredAt := int64(binary.BigEndian.Uint64(data[:8]))
+	if expiredAt > 0 && time.Now().UnixNano() > expiredAt {
+		rc.Delete(key)
+		err = ErrExpired
+		return
+	}
+
+	value = data[8:]
+	return
+}
+
+func (rc *rCache) Set(key string, value []byte, ttl time.Duration) (err error) {
+	data := make([]byte, 8+len(value))
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(data[:8], uint64(time.Now().Add(ttl).UnixNano()))
+	}
+	copy(data[8:], value)
+
+	if ttl > 0 {
+		_, err = rc.pool.do("SET", rc.prefix+key, data, "PX", strconv.FormatInt((ttl+rc.grace).Milliseconds(), 10))
+	} else {
+		_, err = rc.pool.do("SET", rc.prefix+key, data)
+	}
+	return
+}
+
+func (rc *rCache) Delete(key string) (err error) {
+	_, err = rc.pool.do("DEL", rc.prefix+key)
+	return
+}
+
+// Flush deletes all the records with the key prefix of the cache, it refuses to flush the cache
+// without a key prefix since the redis db may be shared with other applications.
+func (rc *rCache) Flush() (err error) {
+	if rc.prefix == "" {
+		return errors.New("redis: can't flush the cache without a key prefix")
+	}
+	cursor := "0"
+	pattern := redisGlobEscaper.Replace(rc.prefix) + "*"
+	for {
+		var ret interface{}
+		ret, err = rc.pool.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return
+		}
+		a, ok := ret.([]interface{})
+		if !ok || len(a) != 2 {
+			return errors.New("redis: invalid SCAN reply")
+		}
+		next, _ := a[0].([]byte)
+		keys, _ := a[1].([]interface{})
+		if len(keys) > 0 {
+			_, err = rc.pool.do("DEL", keys...)
+			if err != nil {
+				return
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// redisPool is a connection pool of redis, at most `size` connections are opened at the same time.
+type redisPool struct {
+	dial func() (*redisConn, error)
+	sem  chan struct{}
+	idle chan *redisConn
+}
+
+func (p *redisPool) do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+
+	var conn *redisConn
+	select {
+	case conn = <-p.idle:
+	default:
+		conn, err = p.dial()
+		if err != nil {
+			return
+		}
+	}
+
+	reply, err = conn.do(cmd, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// the connection is broken
+			conn.Close()
+			return
+		}
+	}
+
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	timeout time.Duration
+	r       *bufio.Reader
+	w       *bufio.Writer
+}
+
+func (c *redisConn) do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case []byte:
+			b = v
+		case string:
+			b = []byte(v)
+		default:
+			b = []byte(fmt.Sprint(v))
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	err = c.w.Flush()
+	if err != nil {
+		return
+	}
+
+	reply, err = c.readReply()
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return
+}
+
+func (c *redisConn) readReply() (reply interface{}, err error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: invalid reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type '%c'", line[0])
+}
+
+type redisCacheDriver struct{}
+
+// Open opens a redis cache by the url `redis:host:port?db=0&prefix=esm:`
+func (rcd *redisCacheDriver) Open(addr string, options url.Values) (Cache, error) {
+	addr = strings.TrimPrefix(addr, "//")
+	addr, db := utils.SplitByFirstByte(addr, '/')
+	if db == "" {
+		db = options.Get("db")
+	}
+	if addr == "" {
+		addr = "localhost:6379"
+	} else if !strings.Contains(addr, ":") {
+		addr += ":6379"
+	}
+	if db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, errors.New("invalid db value")
+		}
+	}
+
+	poolSize := 10
+	if v := options.Get("poolSize"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i <= 0 {
+			return nil, errors.New("invalid poolSize value")
+		}
+		poolSize = i
+	}
+	dialTimeout, err := parseDurationValue(options.Get("dialTimeout"), 5*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid dialTimeout value")
+	}
+	timeout, err := parseDurationValue(options.Get("timeout"), 3*time.Second)
+	if err != nil {
+		return nil, errors.New("invalid timeout value")
+	}
+	grace, err := parseDurationValue(options.Get("grace"), time.Minute)
+	if err != nil {
+		return nil, errors.New("invalid grace value")
+	}
+
+	username := options.Get("username")
+	password := options.Get("password")
+	useTLS := options.Has("tls")
+
+	dial := func() (*redisConn, error) {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		var conn net.Conn
+		var err error
+		if useTLS {
+			host, _ := utils.SplitByLastByte(addr, ':')
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c := &redisConn{
+			Conn:    conn,
+			timeout: timeout,
+			r:       bufio.NewReader(conn),
+			w:       bufio.NewWriter(conn),
+		}
+		if password != "" {
+			if username != "" {
+				_, err = c.do("AUTH", username, password)
+			} else {
+				_, err = c.do("AUTH", password)
+			}
+		}
+		if err == nil && db != "" && db != "0" {
+			_, err = c.do("SELECT", db)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	pool := &redisPool{
+		dial: dial,
+		sem:  make(chan struct{}, poolSize),
+		idle: make(chan *redisConn, poolSize),
+	}
+
+	// check the connection
+	_, err = pool.do("PING")
+	if err != nil {
+		return nil, err
+	}
+
+	return &rCache{
+		pool:   pool,
+		prefix: options.Get("prefix"),
+		grace:  grace,
+	}, nil
+}
+
+func init() {
+	RegisterCache("redis", &redisCacheDriver{})
+}
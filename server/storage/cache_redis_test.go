@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal in-process redis server that supports the commands used by the redis cache.
+type fakeRedis struct {
+	lock     sync.Mutex
+	listener net.Listener
+	password string
+	conns    int
+	data     map[string][]byte
+	expires  map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		listener: l,
+		password: password,
+		data:     map[string][]byte{},
+		expires:  map[string]time.Time{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns++
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err = r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		s.lock.Lock()
+		switch cmd {
+		case "AUTH":
+			if args[len(args)-1] == s.password {
+				authed = true
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "GET":
+			value, ok := s.data[args[1]]
+			if exp, has := s.expires[args[1]]; has && time.Now().After(exp) {
+				ok = false
+			}
+			if ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case "SET":
+			s.data[args[1]] = []byte(args[2])
+			delete(s.expires, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case "DEL":
+			for _, key := range args[1:] {
+				delete(s.data, key)
+				delete(s.expires, key)
+			}
+			fmt.Fprintf(conn, ":%d\r\n", len(args)-1)
+		case "SCAN":
+			keys := []string{}
+			for key := range s.data {
+				if ok, _ := path.Match(args[3], key); ok {
+					keys = append(keys, key)
+				}
+			}
+			fmt.Fprintf(conn, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+			for _, key := range keys {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(key), key)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.listener.Close()
+
+	_, err := OpenCache(fmt.Sprintf("redis:%s?password=wrong", s.listener.Addr()))
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("should be auth error, but %v", err)
+	}
+
+	cache, err := OpenCache(fmt.Sprintf("redis:%s/1?password=secret&prefix=esm:&poolSize=2&grace=3s", s.listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Set("key", []byte("hello world"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := cache.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello world" {
+		t.Fatalf("invalid value(%v), shoud be 'hello world'", value)
+	}
+	s.lock.Lock()
+	_, ok := s.data["esm:key"]
+	s.lock.Unlock()
+	if !ok {
+		t.Fatal("the key should be prefixed with 'esm:'")
+	}
+
+	_, err = cache.Get("key404")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+
+	cache.Set("key2", []byte("hello world"), time.Second)
+	ok, err = cache.Has("key2")
+	if err != nil || !ok {
+		t.Fatal("key2 should be existent")
+	}
+
+	time.Sleep(time.Second)
+	_, err = cache.Get("key2")
+	if err != ErrExpired {
+		t.Fatal("should be expired error, but", err)
+	}
+	_, err = cache.Get("key2")
+	if err != ErrNotFound {
+		t.Fatal("should be not found error, but", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache.Set(fmt.Sprintf("key-%d", i), []byte("hello world"), 0)
+		}(i)
+	}
+	wg.Wait()
+	s.lock.Lock()
+	conns := s.conns
+	s.lock.Unlock()
+	// 1 connection for the auth checking, 2 connections for the pool
+	if conns > 3 {
+		t.Fatalf("too many connections(%d) opened", conns)
+	}
+
+	s.lock.Lock()
+	s.data["other"] = []byte("foo")
+	s.lock.Unlock()
+	err = cache.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	n := len(s.data)
+	s.lock.Unlock()
+	if n != 1 {
+		t.Fatalf("only the prefixed keys should be flushed, %d keys left", n)
+	}
+
+	// never flush the whole db
+	cache, err = OpenCache(fmt.Sprintf("redis:%s/1?password=secret", s.listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Flush() == nil {
+		t.Fatal("the cache without a key prefix should not be flushed")
+	}
+	s.lock.Lock()
+	n = len(s.data)
+	s.lock.Unlock()
+	if n != 1 {
+		t.Fatalf("the keys should not be flushed, %d keys left", n)
+	}
+}
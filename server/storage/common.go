@@ -2,7 +2,10 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ije/gox/utils"
@@ -30,3 +33,26 @@ func parseDurationValue(str string, defaultValue time.Duration) (time.Duration,
 	}
 	return defaultValue, nil
 }
+
+func parseBytesValue(str string, defaultValue int64) (int64, error) {
+	if str == "" {
+		return defaultValue, nil
+	}
+	unit := int64(1)
+	upper := strings.ToUpper(str)
+	for _, u := range []struct {
+		suffix string
+		value  int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, u.suffix) {
+			unit = u.value
+			upper = strings.TrimSuffix(upper, u.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bytes value '%s'", str)
+	}
+	return n * unit, nil
+}
@@ -12,6 +12,12 @@ type DataBase interface {
 	Get(key string) ([]byte, error)
 	Put(key string, value []byte) error
 	Delete(key string) error
+	// Scan calls fn for each record whose key starts with the prefix in lexical order of keys,
+	// the scanning stops if fn returns an error.
+	// fn must not call other methods of the database, and the value is only valid during the call.
+	Scan(prefix string, fn func(key string, value []byte) error) error
+	// DeleteAll deletes all records whose key starts with the prefix.
+	DeleteAll(prefix string) (deleted int, err error)
 	Close() error
 }
 
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"net/url"
 
 	bolt "go.etcd.io/bbolt"
@@ -49,6 +50,41 @@ func (i *boltDB) Delete(key string) error {
 	})
 }
 
+func (i *boltDB) Scan(prefix string, fn func(key string, value []byte) error) error {
+	return i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			err := fn(string(k), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (i *boltDB) DeleteAll(prefix string) (deleted int, err error) {
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(defaultBucket)
+		c := b.Cursor()
+		p := []byte(prefix)
+		keys := [][]byte{}
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return
+}
+
 func (i *boltDB) Close() error {
 	return i.db.Close()
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+var regexpTableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type sqlDialect struct {
+	driverName string
+	blobType   string
+	// the collation to compare the keys byte-wise
+	collate string
+	// returns the placeholder of the nth(start from 1) parameter
+	placeholder func(n int) string
+	// converts the config url to the DSN of the sql driver
+	dsn func(root string, options url.Values) string
+	// statements to run after the connection is opened
+	setup []string
+}
+
+var sqliteDialect = &sqlDialect{
+	driverName: "sqlite",
+	blobType:   "BLOB",
+	// the default `BINARY` collation of sqlite compares the keys byte-wise
+	collate:     "",
+	placeholder: func(n int) string { return "?" },
+	dsn: func(root string, options url.Values) string {
+		return root
+	},
+	setup: []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+	},
+}
+
+var postgresDialect = &sqlDialect{
+	driverName:  "postgres",
+	blobType:    "BYTEA",
+	collate:     ` COLLATE "C"`,
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	dsn: func(root string, options url.Values) string {
+		dsn := "postgres:" + root
+		if len(options) > 0 {
+			dsn += "?" + options.Encode()
+		}
+		return dsn
+	},
+}
+
+type sqlDBDriver struct {
+	dialect *sqlDialect
+}
+
+// Open opens a sql database, the records are stored in a key/value table(default is `esm_kv`)
+// that is created automatically.
+func (driver *sqlDBDriver) Open(root string, options url.Values) (DataBase, error) {
+	table := "esm_kv"
+	maxOpenConns := 0
+	if options != nil {
+		if v := options.Get("table"); v != "" {
+			table = v
+		}
+		if v := options.Get("maxOpenConns"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid maxOpenConns value")
+			}
+			maxOpenConns = i
+		}
+		// remove the options that are not accepted by the sql driver
+		options.Del("table")
+		options.Del("maxOpenConns")
+	}
+	if !regexpTableName.MatchString(table) {
+		return nil, errors.New("invalid table name")
+	}
+
+	db, err := sql.Open(driver.dialect.driverName, driver.dialect.dsn(root, options))
+	if err != nil {
+		return nil, err
+	}
+	if driver.dialect == sqliteDialect {
+		// sqlite allows only one writer at the same time
+		db.SetMaxOpenConns(1)
+	} else if maxOpenConns > 0 {
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+
+	for _, stmt := range driver.dialect.setup {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// bootstrap the schema
+	_, err = db.Exec(fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (key TEXT%s PRIMARY KEY, value %s NOT NULL, updated_at BIGINT NOT NULL)",
+		table,
+		driver.dialect.collate,
+		driver.dialect.blobType,
+	))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	p := driver.dialect.placeholder
+	return &sqlDB{
+		db:      db,
+		getStmt: fmt.Sprintf("SELECT value FROM %s WHERE key = %s", table, p(1)),
+		putStmt: fmt.Sprintf("INSERT INTO %s (key, value, updated_at) VALUES (%s, %s, %s) ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at", table, p(1), p(2), p(3)),
+		delStmt: fmt.Sprintf("DELETE FROM %s WHERE key = %s", table, p(1)),
+		table:   table,
+		dialect: driver.dialect,
+	}, nil
+}
+
+type sqlDB struct {
+	db      *sql.DB
+	getStmt string
+	putStmt string
+	delStmt string
+	table   string
+	dialect *sqlDialect
+}
+
+// Get returns `nil` without error if the record is not found, same as the bolt driver.
+func (i *sqlDB) Get(key string) (value []byte, err error) {
+	err = i.db.QueryRow(i.getStmt, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return
+}
+
+func (i *sqlDB) Put(key string, value []byte) (err error) {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err = i.db.Exec(i.putStmt, key, value, time.Now().Unix())
+	return
+}
+
+func (i *sqlDB) Delete(key string) (err error) {
+	_, err = i.db.Exec(i.delStmt, key)
+	return
+}
+
+func (i *sqlDB) Scan(prefix string, fn func(key string, value []byte) error) (err error) {
+	where, args := i.prefixCondition(prefix)
+	rows, err := i.db.Query(fmt.Sprintf("SELECT key, value FROM %s%s ORDER BY key%s", i.table, where, i.dialect.collate), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return
+		}
+		err = fn(key, value)
+		if err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+func (i *sqlDB) DeleteAll(prefix string) (deleted int, err error) {
+	where, args := i.prefixCondition(prefix)
+	ret, err := i.db.Exec(fmt.Sprintf("DELETE FROM %s%s", i.table, where), args...)
+	if err != nil {
+		return
+	}
+	n, err := ret.RowsAffected()
+	return int(n), err
+}
+
+// prefixCondition matches the prefix by a byte-wise key range that can use the primary key index,
+// instead of `LIKE` that is case-insensitive in sqlite.
+func (i *sqlDB) prefixCondition(prefix string) (where string, args []interface{}) {
+	if prefix == "" {
+		return "", nil
+	}
+	key := "key" + i.dialect.collate
+	p := i.dialect.placeholder
+	upper, ok := prefixUpperBound(prefix)
+	if !ok {
+		return fmt.Sprintf(" WHERE %s >= %s", key, p(1)), []interface{}{prefix}
+	}
+	return fmt.Sprintf(" WHERE %s >= %s AND %s < %s", key, p(1), key, p(2)), []interface{}{prefix, upper}
+}
+
+// prefixUpperBound returns the smallest valid utf-8 string that is greater than all the strings
+// starting with the prefix, `false` is returned if there is no such string.
+func prefixUpperBound(prefix string) (string, bool) {
+	for prefix != "" {
+		r, size := utf8.DecodeLastRuneInString(prefix)
+		prefix = prefix[:len(prefix)-size]
+		if r == utf8.MaxRune {
+			continue
+		}
+		r++
+		if r == 0xD800 {
+			// skip the surrogate halves that are invalid in utf-8
+			r = 0xE000
+		}
+		return prefix + string(r), true
+	}
+	return "", false
+}
+
+func (i *sqlDB) Close() error {
+	return i.db.Close()
+}
+
+func init() {
+	RegisterDB("sqlite", &sqlDBDriver{sqliteDialect})
+	RegisterDB("postgres", &sqlDBDriver{postgresDialect})
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testDataBase tests the contract that every DataBase driver must pass, the db should be empty.
+func testDataBase(t *testing.T, db DataBase) {
+	value, err := db.Get("v127/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Fatal("record should be not existent")
+	}
+
+	err = db.Put("v127/react@18.2.0/es2022/react.mjs", []byte(`{"d":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("v127/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `{"d":true}` {
+		t.Fatalf("invalid value('%s'), shoud be '{\"d\":true}'", value)
+	}
+
+	// update the record
+	err = db.Put("v127/react@18.2.0/es2022/react.mjs", []byte(`{"c":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("v127/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != `{"c":true}` {
+		t.Fatalf("invalid value('%s'), shoud be '{\"c\":true}'", value)
+	}
+
+	err = db.Delete("v127/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("v127/react@18.2.0/es2022/react.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Fatal("record should be deleted")
+	}
+
+	keys := []string{
+		"publish-abc",
+		"v127/React@18.2.0/es2022/react.mjs",
+		"v127/react-dom@18.2.0/es2022/react-dom.mjs",
+		"v127/react@18.2.0/X-ZXhwb3J0cw/es2022/react.mjs",
+		"v127/react@18.2.0/es2022/react.mjs",
+		"v127/react@18.2.0/es2022/react.development.mjs",
+	}
+	for _, key := range keys {
+		err = db.Put(key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scan := func(prefix string) []string {
+		a := []string{}
+		err := db.Scan(prefix, func(key string, value []byte) error {
+			if string(value) != key {
+				t.Fatalf("invalid value('%s') of key '%s'", value, key)
+			}
+			a = append(a, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	for prefix, expected := range map[string][]string{
+		"":                         {keys[0], keys[1], keys[2], keys[3], keys[5], keys[4]},
+		"v127/react@18.2.0/":       {keys[3], keys[5], keys[4]},
+		"v127/react":               {keys[2], keys[3], keys[5], keys[4]},
+		"v127/react@18.2.0/es2022": {keys[5], keys[4]},
+		"v127/vue":                 {},
+	} {
+		if a := scan(prefix); strings.Join(a, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Scan('%s'): invalid keys %v, should be %v", prefix, a, expected)
+		}
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	err = db.Scan("", func(key string, value []byte) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatal("the scanning should be stopped by the error of fn")
+	}
+
+	deleted, err := db.DeleteAll("v127/react@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Fatalf("invalid deleted(%d), should be 3", deleted)
+	}
+	if a := scan(""); strings.Join(a, ",") != strings.Join(keys[:3], ",") {
+		t.Fatalf("invalid keys %v after DeleteAll", a)
+	}
+
+	deleted, err = db.DeleteAll("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Fatalf("invalid deleted(%d), should be 3", deleted)
+	}
+}
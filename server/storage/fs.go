@@ -14,6 +14,12 @@ type FileSystem interface {
 	Stat(path string) (stat FileStat, err error)
 	OpenFile(path string) (content io.ReadSeekCloser, err error)
 	WriteFile(path string, r io.Reader) (written int64, err error)
+	// List returns the paths of all files that start with the prefix, sorted in lexical order.
+	List(prefix string) (paths []string, err error)
+	// Delete deletes the file, no error is returned if the file doesn't exist.
+	Delete(path string) error
+	// DeleteAll deletes all files that start with the prefix.
+	DeleteAll(prefix string) (deleted int, err error)
 }
 
 type FileStat interface {
@@ -27,12 +33,32 @@ type FileSystemDriver interface {
 
 var fsDrivers = sync.Map{}
 
+// the option to skip the startup jobs of the file system, e.g. removing the stale temp files
+// and loading the cache index
+const noInitOption = "noInit"
+
 func OpenFS(fsUrl string) (FileSystem, error) {
+	return openFS(fsUrl, false)
+}
+
+// OpenFSNoInit opens the file system without the startup jobs, for the short-lived processes
+// like the build workers, the jobs are run by the server.
+func OpenFSNoInit(fsUrl string) (FileSystem, error) {
+	return openFS(fsUrl, true)
+}
+
+func openFS(fsUrl string, noInit bool) (FileSystem, error) {
 	name, addr := utils.SplitByFirstByte(fsUrl, ':')
 	fs, ok := fsDrivers.Load(name)
 	if ok {
 		root, options, err := parseConfigUrl(addr)
 		if err == nil {
+			if noInit {
+				if options == nil {
+					options = url.Values{}
+				}
+				options.Set(noInitOption, "true")
+			}
 			return fs.(FileSystemDriver).Open(root, options)
 		}
 	}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// the files smaller than this size are not worth to be compressed
+const compressMinSize = 1024
+
+// CompressedFileSystem stores the compressed variants of the files.
+type CompressedFileSystem interface {
+	FileSystem
+	// OpenCompressedFile opens the compressed variant of the file in the given encoding("br" or "gzip"),
+	// returns `ErrNotFound` if the variant doesn't exist.
+	OpenCompressedFile(path string, encoding string) (content io.ReadSeekCloser, err error)
+}
+
+var compressedFileExts = map[string]bool{
+	".js":   true,
+	".mjs":  true,
+	".cjs":  true,
+	".css":  true,
+	".map":  true,
+	".json": true,
+	".ts":   true,
+	".mts":  true,
+}
+
+var compressionExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// NewCompressedFS returns a file system that stores the brotli and gzip variants of the
+// text files(js, css, source map, etc) alongside with the original files at write time.
+func NewCompressedFS(fs FileSystem) CompressedFileSystem {
+	return &compressedFSLayer{fs}
+}
+
+type compressedFSLayer struct {
+	FileSystem
+}
+
+func (fs *compressedFSLayer) OpenCompressedFile(name string, encoding string) (io.ReadSeekCloser, error) {
+	ext, ok := compressionExts[encoding]
+	if !ok || !compressedFileExts[path.Ext(name)] {
+		return nil, ErrNotFound
+	}
+	return fs.FileSystem.OpenFile(name + ext)
+}
+
+// WriteFile writes the compressed variants before the original file, and the stale variants are
+// removed first, so a variant is never older than the original. The variants are verified after
+// they are written, and the content is spooled to a temp file instead of the memory.
+func (fs *compressedFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
+	if !compressedFileExts[path.Ext(name)] {
+		return fs.FileSystem.WriteFile(name, content)
+	}
+
+	err = fs.deleteVariants(name)
+	if err != nil {
+		return
+	}
+
+	head := make([]byte, compressMinSize)
+	n, err := io.ReadFull(content, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fs.FileSystem.WriteFile(name, bytes.NewReader(head[:n]))
+	}
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "esm-compress-*"+path.Ext(name))
+	if err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	h := sha256.New()
+	err = fs.writeVariants(name, io.TeeReader(io.MultiReader(bytes.NewReader(head), content), io.MultiWriter(tmp, h)))
+	if err == nil {
+		err = fs.verifyVariants(name, h.Sum(nil))
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		written, err = fs.FileSystem.WriteFile(name, tmp)
+	}
+	if err != nil {
+		fs.deleteVariants(name)
+	}
+	return
+}
+
+// writeVariants streams the brotli and gzip variants of the content to the file system.
+func (fs *compressedFSLayer) writeVariants(name string, content io.Reader) (err error) {
+	brReader, brWriter := io.Pipe()
+	gzReader, gzWriter := io.Pipe()
+	errs := make(chan error, 2)
+	go func() {
+		_, err := fs.FileSystem.WriteFile(name+".br", brReader)
+		brReader.CloseWithError(err)
+		errs <- err
+	}()
+	go func() {
+		_, err := fs.FileSystem.WriteFile(name+".gz", gzReader)
+		gzReader.CloseWithError(err)
+		errs <- err
+	}()
+
+	br := brotli.NewWriterLevel(brWriter, 9)
+	gz, _ := gzip.NewWriterLevel(gzWriter, gzip.BestCompression)
+	_, err = io.Copy(io.MultiWriter(br, gz), content)
+	if err == nil {
+		err = br.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	brWriter.CloseWithError(err)
+	gzWriter.CloseWithError(err)
+	for i := 0; i < 2; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// verifyVariants checks the stored variants by the SHA-256 checksum of the original content, since
+// the variants are served without the checksum verification of the builds.
+func (fs *compressedFSLayer) verifyVariants(name string, checksum []byte) (err error) {
+	for encoding, ext := range compressionExts {
+		var f io.ReadSeekCloser
+		f, err = fs.FileSystem.OpenFile(name + ext)
+		if err != nil {
+			return
+		}
+		var r io.Reader = f
+		if encoding == "br" {
+			r = brotli.NewReader(f)
+		} else {
+			r, err = gzip.NewReader(f)
+		}
+		h := sha256.New()
+		if err == nil {
+			_, err = io.Copy(h, r)
+		}
+		f.Close()
+		if err == nil && !bytes.Equal(h.Sum(nil), checksum) {
+			err = fmt.Errorf("%s: checksum mismatch", name+ext)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// List excludes the compressed variants.
+func (fs *compressedFSLayer) List(prefix string) (paths []string, err error) {
+	all, err := fs.FileSystem.List(prefix)
+	if err != nil {
+		return
+	}
+	paths = make([]string, 0, len(all))
+	for _, name := range all {
+		if !isCompressedVariant(name) {
+			paths = append(paths, name)
+		}
+	}
+	return
+}
+
+func (fs *compressedFSLayer) Delete(name string) error {
+	err := fs.FileSystem.Delete(name)
+	if err != nil {
+		return err
+	}
+	return fs.deleteVariants(name)
+}
+
+// DeleteAll returns the number of the deleted original files.
+func (fs *compressedFSLayer) DeleteAll(prefix string) (deleted int, err error) {
+	paths, err := fs.List(prefix)
+	if err != nil {
+		return
+	}
+	_, err = fs.FileSystem.DeleteAll(prefix)
+	if err != nil {
+		return
+	}
+	return len(paths), nil
+}
+
+func (fs *compressedFSLayer) deleteVariants(name string) (err error) {
+	if !compressedFileExts[path.Ext(name)] {
+		return nil
+	}
+	for _, ext := range compressionExts {
+		err = fs.FileSystem.Delete(name + ext)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func isCompressedVariant(name string) bool {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(name, ext) && compressedFileExts[path.Ext(strings.TrimSuffix(name, ext))] {
+			return true
+		}
+	}
+	return false
+}
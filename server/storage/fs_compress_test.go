@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressedFS(t *testing.T) {
+	lfs, err := OpenFS("local:" + filepath.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testFileSystem(t, NewCompressedFS(lfs))
+}
+
+func TestCompressedFSVariants(t *testing.T) {
+	lfs, err := OpenFS("local:" + filepath.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewCompressedFS(lfs)
+
+	code := strings.Repeat("export default 'hello world';\n", 100)
+	_, err = fs.WriteFile("foo.mjs", strings.NewReader(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.OpenCompressedFile("foo.mjs", "br")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(brotli.NewReader(r))
+	r.Close()
+	if err != nil || string(data) != code {
+		t.Fatal("invalid brotli variant", err)
+	}
+
+	r, err = fs.OpenCompressedFile("foo.mjs", "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(gr)
+	r.Close()
+	if err != nil || string(data) != code {
+		t.Fatal("invalid gzip variant", err)
+	}
+
+	// the stale variants are removed when the file is rewritten
+	_, err = fs.WriteFile("foo.mjs", strings.NewReader("export default 'foo'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.OpenCompressedFile("foo.mjs", "br"); err != ErrNotFound {
+		t.Fatal("the stale brotli variant should be removed")
+	}
+	_, err = fs.WriteFile("foo.mjs", strings.NewReader(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// small files and binary files are not compressed
+	fs.WriteFile("bar.mjs", strings.NewReader("export default 'bar'"))
+	fs.WriteFile("foo.wasm", bytes.NewReader(make([]byte, 4096)))
+	for _, name := range []string{"bar.mjs", "foo.wasm"} {
+		if _, err = fs.OpenCompressedFile(name, "br"); err != ErrNotFound {
+			t.Fatalf("%s should not be compressed", name)
+		}
+	}
+
+	paths, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths, ",") != "bar.mjs,foo.mjs,foo.wasm" {
+		t.Fatalf("invalid paths %v", paths)
+	}
+
+	err = fs.Delete("foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lfs.Stat("foo.mjs.br"); err != ErrNotFound {
+		t.Fatal("the brotli variant should be deleted")
+	}
+	if _, err = lfs.Stat("foo.mjs.gz"); err != ErrNotFound {
+		t.Fatal("the gzip variant should be deleted")
+	}
+}
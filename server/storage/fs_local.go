@@ -6,8 +6,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+const tempFilePrefix = ".tmp-"
+
 type localFSDriver struct{}
 
 func (driver *localFSDriver) Open(root string, options url.Values) (FileSystem, error) {
@@ -16,6 +21,10 @@ func (driver *localFSDriver) Open(root string, options url.Values) (FileSystem,
 	if err != nil {
 		return nil, err
 	}
+	if options.Get(noInitOption) == "" {
+		// only remove the stale temp files, the file mtime is not precise enough to tell the in-flight writes
+		go removeTempFiles(root, time.Now().Add(-time.Minute))
+	}
 	return &localFSLayer{root}, nil
 }
 
@@ -44,20 +53,140 @@ func (fs *localFSLayer) OpenFile(name string) (file io.ReadSeekCloser, err error
 	return
 }
 
+// WriteFile writes the content to a temporary file and renames it to the target path after
+// it's synced, so readers never see a partially written file.
 func (fs *localFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
 	fullPath := path.Join(fs.root, name)
-	err = ensureDir(path.Dir(fullPath))
+	dir, base := path.Split(fullPath)
+	err = ensureDir(dir)
 	if err != nil {
 		return
 	}
 
-	file, err := os.Create(fullPath)
+	file, err := os.CreateTemp(dir, tempFilePrefix+base+"-*")
 	if err != nil {
 		return
 	}
-	defer file.Close()
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
 
 	written, err = io.Copy(file, content)
+	if err != nil {
+		return
+	}
+	err = file.Sync()
+	if err != nil {
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		return
+	}
+	err = os.Chmod(file.Name(), 0644)
+	if err != nil {
+		return
+	}
+	err = os.Rename(file.Name(), fullPath)
+	if err != nil {
+		return
+	}
+
+	// sync the directory to persist the rename
+	if d, e := os.Open(dir); e == nil {
+		d.Sync()
+		d.Close()
+	}
+	return
+}
+
+func (fs *localFSLayer) List(prefix string) (paths []string, err error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+	paths = []string{}
+	err = filepath.Walk(path.Join(fs.root, dir), func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(fs.root, fp)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if fi.IsDir() {
+			// skip the directory that can't match the prefix
+			if name != "." && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, prefix) && !strings.HasPrefix(fi.Name(), tempFilePrefix) {
+			paths = append(paths, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return
+}
+
+func (fs *localFSLayer) Delete(name string) error {
+	err := os.Remove(path.Join(fs.root, name))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *localFSLayer) DeleteAll(prefix string) (deleted int, err error) {
+	paths, err := fs.List(prefix)
+	if err != nil {
+		return
+	}
+	dirs := map[string]struct{}{}
+	for _, name := range paths {
+		err = fs.Delete(name)
+		if err != nil {
+			return
+		}
+		deleted++
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = struct{}{}
+		}
+	}
+	// remove empty directories, deepest first
+	a := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		a = append(a, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(a)))
+	for _, dir := range a {
+		os.Remove(path.Join(fs.root, dir)) // fails if the directory is not empty
+	}
+	return
+}
+
+// removeTempFiles removes the temporary files that are left by interrupted writes before the given time.
+func removeTempFiles(root string, before time.Time) (removed int) {
+	filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.HasPrefix(fi.Name(), tempFilePrefix) && fi.ModTime().Before(before) {
+			if os.Remove(fp) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
 	return
 }
 
@@ -2,10 +2,13 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLocalFS(t *testing.T) {
@@ -65,4 +68,74 @@ func TestLocalFS(t *testing.T) {
 	if err != ErrNotFound {
 		t.Fatalf("File should be not existent")
 	}
+
+	fs, err = OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFileSystem(t, fs)
+}
+
+type errReader struct {
+	r io.Reader
+}
+
+func (r *errReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return
+}
+
+func TestLocalFSAtomicWrite(t *testing.T) {
+	root := t.TempDir()
+	fs, err := OpenFS("local:" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.WriteFile("builds/foo.mjs", bytes.NewBufferString("export default 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted write should not change the file
+	_, err = fs.WriteFile("builds/foo.mjs", &errReader{bytes.NewBufferString("export default")})
+	if err == nil {
+		t.Fatal("should return the error of the reader")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "builds/foo.mjs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "export default 1" {
+		t.Fatalf("invalid file content('%s'), shoud be 'export default 1'", data)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("the temporary file should be removed, but %d files found", len(entries))
+	}
+
+	// the temporary files left by a crash should be removed on startup
+	err = os.WriteFile(filepath.Join(root, "builds", tempFilePrefix+"bar.mjs-123"), []byte("export"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := fs.List("builds/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "builds/foo.mjs" {
+		t.Fatalf("the temporary file should not be listed, but %v", paths)
+	}
+	if n := removeTempFiles(root, time.Now().Add(time.Second)); n != 1 {
+		t.Fatalf("invalid removed(%d), should be 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(root, "builds/foo.mjs")); err != nil {
+		t.Fatal(err)
+	}
 }
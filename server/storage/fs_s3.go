@@ -0,0 +1,600 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+)
+
+const s3MinPartSize = 5 * 1024 * 1024
+
+var emptyPayloadHash = sha256Hex(nil)
+
+type s3FSDriver struct{}
+
+// Open opens a S3-compatible file system by the url `s3:bucket/prefix?endpoint=...&region=...`
+func (driver *s3FSDriver) Open(root string, options url.Values) (FileSystem, error) {
+	bucket, prefix := utils.SplitByFirstByte(strings.Trim(root, "/"), '/')
+	prefix = strings.Trim(prefix, "/")
+	if bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+
+	region := options.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	accessKeyID := options.Get("accessKeyId")
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	secretAccessKey := options.Get("secretAccessKey")
+	if secretAccessKey == "" {
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	partSize, err := parseBytesValue(options.Get("partSize"), 8*1024*1024)
+	if err != nil || partSize < s3MinPartSize {
+		return nil, errors.New("invalid partSize value")
+	}
+
+	// use virtual-hosted style for AWS, path style for other S3-compatible services
+	pathStyle := true
+	endpoint := options.Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		pathStyle = options.Has("pathStyle")
+	} else if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointUrl, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, errors.New("invalid endpoint")
+	}
+
+	// the timeout of a request, includes reading the response body
+	timeout, err := parseDurationValue(options.Get("timeout"), time.Minute)
+	if err != nil || timeout <= 0 {
+		return nil, errors.New("invalid timeout value")
+	}
+
+	return &s3FSLayer{
+		client:          &http.Client{},
+		timeout:         timeout,
+		endpoint:        endpointUrl,
+		bucket:          bucket,
+		prefix:          prefix,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		pathStyle:       pathStyle,
+		partSize:        partSize,
+	}, nil
+}
+
+type s3FSLayer struct {
+	client          *http.Client
+	timeout         time.Duration
+	endpoint        *url.URL
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	pathStyle       bool
+	partSize        int64
+}
+
+type s3FileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (s *s3FileStat) Size() int64 {
+	return s.size
+}
+
+func (s *s3FileStat) ModTime() time.Time {
+	return s.modTime
+}
+
+func (fs *s3FSLayer) Stat(name string) (FileStat, error) {
+	ctx, cancel := fs.context()
+	defer cancel()
+	res, err := fs.do(ctx, http.MethodHead, fs.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return parseS3FileStat(res.Header), nil
+}
+
+func (fs *s3FSLayer) OpenFile(name string) (io.ReadSeekCloser, error) {
+	stat, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{fs: fs, key: fs.key(name), size: stat.Size()}, nil
+}
+
+// WriteFile uploads the content in a single request if it's smaller than the part size,
+// otherwise it streams the content to S3 with the multipart upload API.
+func (fs *s3FSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
+	key := fs.key(name)
+	buf := bytes.NewBuffer(nil)
+
+	n, err := io.CopyN(buf, content, fs.partSize)
+	if err != nil && err != io.EOF {
+		return
+	}
+	if err == io.EOF {
+		ctx, cancel := fs.context()
+		defer cancel()
+		var res *http.Response
+		res, err = fs.do(ctx, http.MethodPut, key, nil, nil, buf.Bytes())
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		return n, nil
+	}
+
+	uploadID, err := fs.createMultipartUpload(key)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			ctx, cancel := fs.context()
+			defer cancel()
+			res, e := fs.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+			if e == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	parts := []s3CompletedPart{}
+	for partNumber := 1; ; partNumber++ {
+		if buf.Len() > 0 {
+			var res *http.Response
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {uploadID},
+			}
+			ctx, cancel := fs.context()
+			res, err = fs.do(ctx, http.MethodPut, key, query, nil, buf.Bytes())
+			if err != nil {
+				cancel()
+				return
+			}
+			res.Body.Close()
+			cancel()
+			parts = append(parts, s3CompletedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+			written += int64(buf.Len())
+			buf.Reset()
+		}
+		_, err = io.CopyN(buf, content, fs.partSize)
+		if err == io.EOF {
+			if buf.Len() > 0 {
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = fs.completeMultipartUpload(key, uploadID, parts)
+	return
+}
+
+func (fs *s3FSLayer) List(prefix string) (paths []string, err error) {
+	keyPrefix := strings.TrimPrefix(prefix, "/")
+	if fs.prefix != "" {
+		keyPrefix = fs.prefix + "/" + keyPrefix
+	}
+	paths = []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {keyPrefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		ctx, cancel := fs.context()
+		var res *http.Response
+		res, err = fs.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		var ret struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&ret)
+		res.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range ret.Contents {
+			name := c.Key
+			if fs.prefix != "" {
+				name = strings.TrimPrefix(name, fs.prefix+"/")
+			}
+			paths = append(paths, name)
+		}
+		if !ret.IsTruncated || ret.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = ret.NextContinuationToken
+	}
+	sort.Strings(paths)
+	return
+}
+
+func (fs *s3FSLayer) Delete(name string) error {
+	ctx, cancel := fs.context()
+	defer cancel()
+	res, err := fs.do(ctx, http.MethodDelete, fs.key(name), nil, nil, nil)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (fs *s3FSLayer) DeleteAll(prefix string) (deleted int, err error) {
+	paths, err := fs.List(prefix)
+	if err != nil {
+		return
+	}
+	for _, name := range paths {
+		err = fs.Delete(name)
+		if err != nil {
+			return
+		}
+		deleted++
+	}
+	return
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (fs *s3FSLayer) createMultipartUpload(key string) (uploadID string, err error) {
+	ctx, cancel := fs.context()
+	defer cancel()
+	res, err := fs.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var ret struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&ret)
+	if err != nil {
+		return
+	}
+	if ret.UploadID == "" {
+		err = errors.New("s3: missing upload id")
+		return
+	}
+	return ret.UploadID, nil
+}
+
+func (fs *s3FSLayer) completeMultipartUpload(key string, uploadID string, parts []s3CompletedPart) (err error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := fs.context()
+	defer cancel()
+	res, err := fs.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	// S3 may return an error in the body of a `200 OK` response
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	return parseS3Error(http.MethodPost, key, res.StatusCode, data)
+}
+
+func (fs *s3FSLayer) key(name string) string {
+	return strings.TrimPrefix(path.Join(fs.prefix, name), "/")
+}
+
+// context returns a context that is canceled after the timeout of the file system.
+func (fs *s3FSLayer) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), fs.timeout)
+}
+
+// do sends a signed request to the S3 server, a `404` response returns `ErrNotFound`.
+func (fs *s3FSLayer) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (res *http.Response, err error) {
+	host := fs.endpoint.Host
+	uri := strings.TrimSuffix(fs.endpoint.Path, "/")
+	if fs.pathStyle {
+		uri += "/" + fs.bucket
+	} else {
+		host = fs.bucket + "." + host
+	}
+	uri += "/" + s3Escape(key, false)
+	rawQuery := s3CanonicalQuery(query)
+	reqUrl := fmt.Sprintf("%s://%s%s", fs.endpoint.Scheme, host, uri)
+	if rawQuery != "" {
+		reqUrl += "?" + rawQuery
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqUrl, r)
+	if err != nil {
+		return
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	fs.sign(req, uri, rawQuery, body, time.Now())
+
+	res, err = fs.client.Do(req)
+	if err != nil {
+		return
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound && method != http.MethodPost {
+			return nil, ErrNotFound
+		}
+		data, _ := io.ReadAll(res.Body)
+		err = parseS3Error(method, key, res.StatusCode, data)
+		if err == nil {
+			err = fmt.Errorf("s3: %s %s: %s", method, key, res.Status)
+		}
+		return nil, err
+	}
+	return
+}
+
+// sign signs the request with AWS Signature Version 4, anonymous requests are sent if no credentials provided.
+func (fs *s3FSLayer) sign(req *http.Request, uri string, rawQuery string, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if fs.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", fs.sessionToken)
+	}
+	if fs.accessKeyID == "" || fs.secretAccessKey == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") || key == "content-type" || key == "range" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for key := range headers {
+		headerNames = append(headerNames, key)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := bytes.NewBuffer(nil)
+	for _, key := range headerNames {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", key, headers[key])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, fs.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+fs.secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, fs.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		fs.accessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// s3Object implements the `io.ReadSeekCloser` interface with ranged reads,
+// the object body is requested lazily from the current offset.
+type s3Object struct {
+	fs     *s3FSLayer
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (o *s3Object) Read(p []byte) (n int, err error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		ctx, cancel := o.fs.context()
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		res, err := o.fs.do(ctx, http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		o.body = res.Body
+		o.cancel = cancel
+	}
+	n, err = o.body.Read(p)
+	o.offset += int64(n)
+	return
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		o.Close()
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		err := o.body.Close()
+		o.cancel()
+		o.body = nil
+		o.cancel = nil
+		return err
+	}
+	return nil
+}
+
+func parseS3FileStat(header http.Header) *s3FileStat {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	return &s3FileStat{size, modTime}
+}
+
+func parseS3Error(method string, key string, statusCode int, data []byte) error {
+	var ret struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &ret) != nil || ret.Code == "" {
+		return nil
+	}
+	return fmt.Errorf("s3: %s %s: %s(%d) %s", method, key, ret.Code, statusCode, ret.Message)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	a := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			a = append(a, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(a, "&")
+}
+
+func s3Escape(s string, encodeSlash bool) string {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func init() {
+	RegisterFileSystem("s3", &s3FSDriver{})
+}
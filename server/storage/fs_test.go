@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testFileSystem tests the contract that every FileSystem driver must pass, the fs should be empty.
+func testFileSystem(t *testing.T, fs FileSystem) {
+	files := []string{
+		"builds/v127/react@18.2.0/es2022/react.mjs",
+		"builds/v127/react@18.2.0/es2022/react.mjs.map",
+		"builds/v127/react@18.2.0/X-ZXhwb3J0cw/es2022/react.mjs",
+		"builds/v127/react@18.2.0.1/es2022/react.mjs",
+		"builds/v127/react-dom@18.2.0/es2022/react-dom.mjs",
+		"types/v127/react@18.2.0/index.d.ts",
+	}
+	for _, name := range files {
+		_, err := fs.WriteFile(name, bytes.NewBufferString(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// overwrite
+	_, err := fs.WriteFile(files[0], bytes.NewBufferString("export default {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "export default {}" {
+		t.Fatalf("invalid file content('%s'), shoud be 'export default {}'", data)
+	}
+
+	for prefix, expected := range map[string][]string{
+		"":                                files,
+		"builds/v127/react@18.2.0/":       {files[2], files[0], files[1]},
+		"builds/v127/react@18.2.0":        {files[3], files[2], files[0], files[1]},
+		"builds/v127/react":               {files[4], files[3], files[2], files[0], files[1]},
+		"builds/v127/react@18.2.0/es2022": {files[0], files[1]},
+		"types/":                          {files[5]},
+		"builds/v127/vue@3.3.4/":          {},
+	} {
+		paths, err := fs.List(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix == "" {
+			if len(paths) != len(files) {
+				t.Fatalf("List(''): invalid paths %v", paths)
+			}
+			continue
+		}
+		if strings.Join(paths, ",") != strings.Join(expected, ",") {
+			t.Fatalf("List('%s'): invalid paths %v, should be %v", prefix, paths, expected)
+		}
+	}
+
+	err = fs.Delete(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(files[1])
+	if err != ErrNotFound {
+		t.Fatalf("File should be deleted")
+	}
+	err = fs.Delete(files[1])
+	if err != nil {
+		t.Fatalf("Deleting an non-existent file should not return error, but %v", err)
+	}
+
+	deleted, err := fs.DeleteAll("builds/v127/react@18.2.0/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("invalid deleted(%d), should be 2", deleted)
+	}
+	paths, err := fs.List("builds/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths, ",") != files[4]+","+files[3] {
+		t.Fatalf("invalid paths %v after DeleteAll", paths)
+	}
+
+	deleted, err = fs.DeleteAll("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Fatalf("invalid deleted(%d), should be 3", deleted)
+	}
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tieredFSDriver struct{}
+
+// Open opens a tiered file system that caches the files of the `backing` file system in the local
+// directory, the least recently used files are evicted when the `maxSize`(default is 1GB) limit is reached.
+// Other options are passed to the backing file system, e.g.
+// `tiered:/var/cache/esm?maxSize=10GB&backing=s3:bucket/prefix&region=us-east-1`
+func (driver *tieredFSDriver) Open(root string, options url.Values) (FileSystem, error) {
+	backingUrl := options.Get("backing")
+	if backingUrl == "" {
+		return nil, errors.New("missing backing fs")
+	}
+	maxSize, err := parseBytesValue(options.Get("maxSize"), 1<<30)
+	if err != nil || maxSize == 0 {
+		return nil, errors.New("invalid maxSize value")
+	}
+
+	// pass the rest options to the backing file system
+	options.Del("backing")
+	options.Del("maxSize")
+	if len(options) > 0 {
+		if strings.ContainsRune(backingUrl, '?') {
+			backingUrl += "&" + options.Encode()
+		} else {
+			backingUrl += "?" + options.Encode()
+		}
+	}
+	if strings.HasPrefix(backingUrl, "tiered:") {
+		return nil, errors.New("invalid backing fs")
+	}
+	backing, err := OpenFS(backingUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	noInit := options.Get(noInitOption) != ""
+	localOptions := url.Values{}
+	if noInit {
+		localOptions.Set(noInitOption, "true")
+	}
+	local, err := (&localFSDriver{}).Open(root, localOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &tieredFSLayer{
+		local:   local.(*localFSLayer),
+		backing: backing,
+		maxSize: maxSize,
+		lru:     list.New(),
+		index:   map[string]*list.Element{},
+	}
+	// the files that are cached by other processes are not indexed without the startup jobs
+	if !noInit {
+		err = fs.loadIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+type tieredEntry struct {
+	name string
+	size int64
+}
+
+// tieredFSLayer reads through and writes through the local cache, the backing file system is the source of truth.
+type tieredFSLayer struct {
+	local      *localFSLayer
+	backing    FileSystem
+	maxSize    int64
+	lock       sync.Mutex
+	size       int64
+	lru        *list.List
+	index      map[string]*list.Element
+	fetchLocks sync.Map
+}
+
+func (fs *tieredFSLayer) Stat(name string) (FileStat, error) {
+	if fs.touch(name) {
+		fi, err := fs.local.Stat(name)
+		if err == nil {
+			return fi, nil
+		}
+		fs.remove(name)
+	}
+	return fs.backing.Stat(name)
+}
+
+func (fs *tieredFSLayer) OpenFile(name string) (io.ReadSeekCloser, error) {
+	if fs.touch(name) {
+		file, err := fs.local.OpenFile(name)
+		if err == nil {
+			return file, nil
+		}
+		fs.remove(name)
+	}
+
+	// only one request fetches the file from the backing file system
+	v, _ := fs.fetchLocks.LoadOrStore(name, &sync.Mutex{})
+	lock := v.(*sync.Mutex)
+	lock.Lock()
+	defer func() {
+		fs.fetchLocks.Delete(name)
+		lock.Unlock()
+	}()
+
+	// the file may be fetched by another request
+	if fs.touch(name) {
+		file, err := fs.local.OpenFile(name)
+		if err == nil {
+			return file, nil
+		}
+		fs.remove(name)
+	}
+
+	r, err := fs.backing.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fs.local.WriteFile(name, r)
+	r.Close()
+	if err != nil {
+		// serve the file from the backing file system if failed to cache it
+		fs.local.Delete(name)
+		return fs.backing.OpenFile(name)
+	}
+	file, err := fs.local.OpenFile(name)
+	if err != nil {
+		return fs.backing.OpenFile(name)
+	}
+	fs.add(name, size)
+	return file, nil
+}
+
+// WriteFile writes the file to the local cache first, then uploads it to the backing file system.
+func (fs *tieredFSLayer) WriteFile(name string, content io.Reader) (written int64, err error) {
+	fs.remove(name)
+	written, err = fs.local.WriteFile(name, content)
+	if err != nil {
+		fs.local.Delete(name)
+		return
+	}
+	file, err := fs.local.OpenFile(name)
+	if err != nil {
+		fs.local.Delete(name)
+		return
+	}
+	_, err = fs.backing.WriteFile(name, file)
+	file.Close()
+	if err != nil {
+		fs.local.Delete(name)
+		return
+	}
+	fs.add(name, written)
+	return
+}
+
+func (fs *tieredFSLayer) List(prefix string) ([]string, error) {
+	return fs.backing.List(prefix)
+}
+
+func (fs *tieredFSLayer) Delete(name string) error {
+	err := fs.backing.Delete(name)
+	if err != nil {
+		return err
+	}
+	fs.remove(name)
+	return nil
+}
+
+func (fs *tieredFSLayer) DeleteAll(prefix string) (deleted int, err error) {
+	deleted, err = fs.backing.DeleteAll(prefix)
+	if err != nil {
+		return
+	}
+	fs.lock.Lock()
+	for name, el := range fs.index {
+		if strings.HasPrefix(name, prefix) {
+			fs.size -= fs.lru.Remove(el).(*tieredEntry).size
+			delete(fs.index, name)
+		}
+	}
+	fs.lock.Unlock()
+	_, err = fs.local.DeleteAll(prefix)
+	return
+}
+
+// touch marks the file as recently used, returns false if the file is not cached. The modtime of
+// the cached file is updated as the last access time, see `loadIndex`.
+func (fs *tieredFSLayer) touch(name string) bool {
+	fs.lock.Lock()
+	el, ok := fs.index[name]
+	if ok {
+		fs.lru.MoveToFront(el)
+	}
+	fs.lock.Unlock()
+
+	if ok {
+		now := time.Now()
+		os.Chtimes(filepath.Join(fs.local.root, filepath.FromSlash(name)), now, now)
+	}
+	return ok
+}
+
+// add adds the cached file to the index and evicts the least recently used files if the cache is full.
+func (fs *tieredFSLayer) add(name string, size int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if el, ok := fs.index[name]; ok {
+		fs.size -= fs.lru.Remove(el).(*tieredEntry).size
+	}
+	fs.index[name] = fs.lru.PushFront(&tieredEntry{name, size})
+	fs.size += size
+	fs.evict()
+}
+
+func (fs *tieredFSLayer) remove(name string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if el, ok := fs.index[name]; ok {
+		fs.size -= fs.lru.Remove(el).(*tieredEntry).size
+		delete(fs.index, name)
+	}
+	fs.local.Delete(name)
+}
+
+// evict evicts the least recently used files, the caller must hold the lock.
+func (fs *tieredFSLayer) evict() {
+	for fs.size > fs.maxSize && fs.lru.Len() > 0 {
+		e := fs.lru.Remove(fs.lru.Back()).(*tieredEntry)
+		delete(fs.index, e.name)
+		fs.size -= e.size
+		fs.local.Delete(e.name)
+	}
+}
+
+// loadIndex loads the cached files in the local directory, the modtime is used as the last access time.
+func (fs *tieredFSLayer) loadIndex() error {
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	files := []cachedFile{}
+	err := filepath.Walk(fs.local.root, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), tempFilePrefix) {
+			return err
+		}
+		rel, err := filepath.Rel(fs.local.root, fp)
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{filepath.ToSlash(rel), fi.Size(), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for _, f := range files {
+		fs.index[f.name] = fs.lru.PushFront(&tieredEntry{f.name, f.size})
+		fs.size += f.size
+	}
+	fs.evict()
+	return nil
+}
+
+func init() {
+	RegisterFileSystem("tiered", &tieredFSDriver{})
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTieredFS(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFS("tiered:" + filepath.Join(dir, "cache") + "?backing=local:" + filepath.Join(dir, "backing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testFileSystem(t, fs)
+}
+
+func TestTieredFSCache(t *testing.T) {
+	dir := t.TempDir()
+	backing, err := OpenFS("local:" + filepath.Join(dir, "backing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := OpenFS("tiered:" + filepath.Join(dir, "cache") + "?maxSize=10&backing=local:" + filepath.Join(dir, "backing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfs := fs.(*tieredFSLayer)
+
+	// write through
+	_, err = fs.WriteFile("a.txt", bytes.NewBufferString("aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = backing.Stat("a.txt"); err != nil {
+		t.Fatal("a.txt should be written to the backing fs")
+	}
+	if _, err = tfs.local.Stat("a.txt"); err != nil {
+		t.Fatal("a.txt should be cached")
+	}
+
+	// read through
+	backing.WriteFile("b.txt", bytes.NewBufferString("bbbb"))
+	r, err := fs.OpenFile("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "bbbb" {
+		t.Fatalf("invalid content '%s', should be 'bbbb'", data)
+	}
+	if _, err = tfs.local.Stat("b.txt"); err != nil {
+		t.Fatal("b.txt should be cached")
+	}
+
+	// a.txt is the least recently used file, evicted when the size exceeds 10 bytes
+	fs.Stat("b.txt")
+	_, err = fs.WriteFile("c.txt", bytes.NewBufferString("cccc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tfs.local.Stat("a.txt"); err != ErrNotFound {
+		t.Fatal("a.txt should be evicted")
+	}
+	if tfs.size != 8 || tfs.lru.Len() != 2 {
+		t.Fatalf("invalid cache size(%d) or entries(%d)", tfs.size, tfs.lru.Len())
+	}
+	r, err = fs.OpenFile("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "aaaa" {
+		t.Fatalf("invalid content '%s', should be 'aaaa'", data)
+	}
+
+	// the access time is recorded by the modtime
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a.txt", "c.txt"} {
+		os.Chtimes(filepath.Join(dir, "cache", name), past, past)
+	}
+	fs.Stat("c.txt")
+
+	// the index is restored from the local directory
+	fs2, err := OpenFS("tiered:" + filepath.Join(dir, "cache") + "?maxSize=10&backing=local:" + filepath.Join(dir, "backing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs2.(*tieredFSLayer).size; n != 8 {
+		t.Fatalf("invalid restored cache size(%d), should be 8", n)
+	}
+	if name := fs2.(*tieredFSLayer).lru.Front().Value.(*tieredEntry).name; name != "c.txt" {
+		t.Fatalf("c.txt should be the most recently used file, but %s", name)
+	}
+
+	// the index is not loaded without the startup jobs
+	fs3, err := OpenFSNoInit("tiered:" + filepath.Join(dir, "cache") + "?maxSize=10&backing=local:" + filepath.Join(dir, "backing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs3.(*tieredFSLayer).lru.Len(); n != 0 {
+		t.Fatalf("the index should not be loaded, but got %d entries", n)
+	}
+
+	_, err = OpenFS("tiered:" + filepath.Join(dir, "cache"))
+	if err == nil || !strings.Contains(err.Error(), "backing") {
+		t.Fatal("should be missing backing error, but", err)
+	}
+}
@@ -77,6 +77,41 @@ func (s *stringSet) Values() []string {
 	return a
 }
 
+type stringMap struct {
+	lock sync.RWMutex
+	m    map[string]string
+}
+
+func newStringMap() *stringMap {
+	return &stringMap{m: map[string]string{}}
+}
+
+func (m *stringMap) Get(key string) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	value, ok := m.m[key]
+	return value, ok
+}
+
+func (m *stringMap) Set(key string, value string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.m[key] = value
+}
+
+func (m *stringMap) Map() map[string]string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	c := make(map[string]string, len(m.m))
+	for key, value := range m.m {
+		c[key] = value
+	}
+	return c
+}
+
 type StringOrMap struct {
 	Value string
 	Map   map[string]interface{}
@@ -2,15 +2,19 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +23,7 @@ import (
 	"github.com/ije/esbuild-internal/js_ast"
 	"github.com/ije/esbuild-internal/js_parser"
 	"github.com/ije/esbuild-internal/logger"
+	"github.com/ije/gox/utils"
 )
 
 const EOL = "\n"
@@ -111,6 +116,15 @@ func sliceMap(a []string, fn func(s string) string) []string {
 	return b
 }
 
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func cloneMap(m map[string]string) map[string]string {
 	n := make(map[string]string, len(m))
 	for k, v := range m {
@@ -128,6 +142,42 @@ func endsWith(s string, suffixs ...string) bool {
 	return false
 }
 
+// getBuildFileContentType returns the content type of the build file, or an empty string if it's unknown.
+func getBuildFileContentType(reqType string, pathname string, savePath string) string {
+	if reqType == "types" {
+		return "application/typescript; charset=utf-8"
+	}
+	if endsWith(pathname, ".js", ".mjs", ".jsx", ".ts", ".mts", ".tsx") {
+		return "application/javascript; charset=utf-8"
+	}
+	if strings.HasSuffix(savePath, ".map") {
+		return "application/json; charset=utf-8"
+	}
+	return mime.TypeByExtension(path.Ext(savePath))
+}
+
+// getAcceptEncoding returns the preferred encoding("br" or "gzip") of the `Accept-Encoding` header.
+func getAcceptEncoding(header string) string {
+	var encoding string
+	for _, p := range strings.Split(header, ",") {
+		name, params := utils.SplitByFirstByte(p, ';')
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "br":
+			encoding = "br"
+		case "gzip":
+			if encoding == "" {
+				encoding = "gzip"
+			}
+		}
+	}
+	return encoding
+}
+
 func dirExists(filepath string) bool {
 	fi, err := os.Lstat(filepath)
 	return err == nil && fi.IsDir()
@@ -335,3 +385,10 @@ func concatBytes(a, b []byte) []byte {
 func jsDataUrl(code string) string {
 	return fmt.Sprintf("data:text/javascript;base64,%s", base64.StdEncoding.EncodeToString([]byte(code)))
 }
+
+// randomID returns a random hex string for the lease/job IDs.
+func randomID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+	logx "github.com/ije/gox/log"
+)
+
+// remoteWorker leases the build tasks from the coordinator, builds them and writes the
+// artifacts to the shared storage.
+type remoteWorker struct {
+	id          string
+	coordinator string
+	secret      string
+	client      *http.Client
+	build       func(ctx context.Context, task *BuildTask) (*ESMBuild, error)
+}
+
+// run runs the worker loop with the concurrency until the context is done.
+func (w *remoteWorker) run(ctx context.Context, concurrency int) {
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				lease, err := w.lease(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Warnf("worker: lease: %v", err)
+						time.Sleep(time.Second)
+					}
+					continue
+				}
+				if lease != nil {
+					w.process(ctx, lease)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *remoteWorker) process(ctx context.Context, lease *workerLease) {
+	task := lease.Task.toBuildTask()
+	buildCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// keep the lease alive, cancel the build if the lease is lost
+	go func() {
+		ttl := time.Duration(lease.TTL) * time.Millisecond
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-buildCtx.Done():
+				return
+			case <-ticker.C:
+				err := w.call(buildCtx, "heartbeat", workerHeartbeat{LeaseID: lease.ID}, nil)
+				if err == errLeaseLost {
+					log.Warnf("worker: lease of '%s' is lost, cancel the build", task.ID())
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	start := time.Now()
+	esm, err := w.build(buildCtx, task)
+	if buildCtx.Err() != nil {
+		return
+	}
+	cancel()
+
+	result := workerResult{LeaseID: lease.ID}
+	if err != nil {
+		log.Errorf("worker: build '%s': %v", task.ID(), err)
+		result.Error = err.Error()
+	} else {
+		log.Infof("worker: build '%s' done in %v", task.ID(), time.Since(start))
+		result.ESM = esm
+		result.Deprecated = task.Deprecated
+	}
+	err = w.call(ctx, "complete", result, nil)
+	if err != nil {
+		log.Warnf("worker: complete '%s': %v", task.ID(), err)
+	}
+}
+
+func (w *remoteWorker) lease(ctx context.Context) (lease *workerLease, err error) {
+	err = w.call(ctx, "lease", workerLeaseRequest{WorkerID: w.id, Wait: 30000}, &lease)
+	return
+}
+
+// call posts the JSON request to the coordinator, the `ret` is nil if the response is "204 No Content".
+func (w *remoteWorker) call(ctx context.Context, method string, req interface{}, ret interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", w.coordinator+"/_worker/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		r.Header.Set("Authorization", "Bearer "+w.secret)
+	}
+	res, err := w.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		if ret != nil {
+			return json.NewDecoder(res.Body).Decode(ret)
+		}
+		return nil
+	case http.StatusNoContent:
+		return nil
+	case http.StatusGone:
+		return errLeaseLost
+	default:
+		return fmt.Errorf("coordinator: %s", res.Status)
+	}
+}
+
+// Worker runs the `esmd worker` command that builds the tasks of the coordinator.
+func Worker(args []string) {
+	var (
+		cfile       string
+		coordinator string
+		concurrency int
+		err         error
+	)
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	flags.StringVar(&cfile, "config", "config.json", "the config file path")
+	flags.StringVar(&coordinator, "coordinator", "", "the coordinator url, e.g. http://10.0.0.1:8080")
+	flags.IntVar(&concurrency, "concurrency", 0, "the max number of the concurrent tasks, default is the sum of the stage concurrency of the config")
+	flags.Parse(args)
+
+	if coordinator == "" {
+		fmt.Println("missing coordinator url")
+		os.Exit(1)
+	}
+
+	if !fileExists(cfile) {
+		cfg = config.Default()
+		fmt.Println("Config file not found, use default config")
+	} else {
+		cfg, err = config.Load(cfile)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Config loaded from", cfile)
+	}
+	if concurrency <= 0 {
+		concurrency = int(cfg.InstallConcurrency + cfg.BuildConcurrency + cfg.TypesConcurrency)
+	}
+	initStagePools()
+
+	log, err = logx.New(fmt.Sprintf("file:%s?buffer=32k", path.Join(cfg.LogDir, fmt.Sprintf("worker-v%d.log", VERSION))))
+	if err != nil {
+		fmt.Printf("initiate logger: %v\n", err)
+		os.Exit(1)
+	}
+	log.SetLevelByName(cfg.LogLevel)
+
+	nodeInstallDir := os.Getenv("NODE_INSTALL_DIR")
+	if nodeInstallDir == "" {
+		nodeInstallDir = path.Join(cfg.WorkDir, "nodejs")
+	}
+	_, _, err = checkNodejs(nodeInstallDir)
+	if err != nil {
+		log.Fatalf("check nodejs: %v", err)
+	}
+	if cfg.NpmRegistry == "" {
+		output, err := exec.Command("npm", "config", "get", "registry").CombinedOutput()
+		if err == nil {
+			cfg.NpmRegistry = strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
+		}
+	}
+
+	cache, err = storage.OpenCache(cfg.Cache)
+	if err != nil {
+		log.Fatalf("init storage(cache,%s): %v", cfg.Cache, err)
+	}
+	fs, err = storage.OpenFS(cfg.Storage)
+	if err != nil {
+		log.Fatalf("init storage(fs,%s): %v", cfg.Storage, err)
+	}
+	if !cfg.NoCompress {
+		fs = storage.NewCompressedFS(fs)
+	}
+	db, err = storage.OpenDB(cfg.Database)
+	if err != nil {
+		log.Fatalf("init storage(db,%s): %v", cfg.Database, err)
+	}
+
+	// start node services process
+	go func() {
+		for {
+			err := startNodeServices()
+			if err != nil && err.Error() != "signal: interrupt" {
+				log.Warnf("node services exit: %v", err)
+			}
+			time.Sleep(time.Second / 10)
+		}
+	}()
+
+	hostname, _ := os.Hostname()
+	w := &remoteWorker{
+		id:          fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		coordinator: strings.TrimSuffix(coordinator, "/"),
+		secret:      cfg.AuthSecret,
+		client:      &http.Client{},
+		build: func(ctx context.Context, task *BuildTask) (*ESMBuild, error) {
+			return task.safeBuild(ctx)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	log.Infof("worker '%s' is ready, coordinator: %s", w.id, w.coordinator)
+	w.run(ctx, concurrency)
+
+	// release resources
+	kill(nsPidFile)
+	db.Close()
+	log.FlushBuffer()
+}